@@ -0,0 +1,120 @@
+package grouped
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// Invalidation is an event describing values removed from a Cache, published to an InvalidationBus
+// so that other caches can remove their copies of the values.
+type Invalidation struct {
+	// Identifies the cache that published the event, so that it can ignore its own events.
+	Source string `json:"source"`
+	// Whether the event is for a single key or for a tag.
+	Kind InvalidationKind `json:"kind"`
+	// The key removed by Delete or DeleteUnless, if the event is for a single key.
+	Key string `json:"key"`
+	// The tag removed by InvalidateTag, if the event is for a tag.
+	Tag string `json:"tag"`
+}
+
+// InvalidationKind describes what an Invalidation removes, so that events for the empty key or tag
+// can be told apart.
+type InvalidationKind int
+
+const (
+	// The event removes the value for its Key.
+	KeyInvalidation InvalidationKind = iota + 1
+	// The event removes the values with its Tag.
+	TagInvalidation
+)
+
+// InvalidationBus distributes invalidation events between caches, such as between the replicas of
+// a service.
+type InvalidationBus interface {
+	// Publish sends the event to the subscribers of the bus.
+	Publish(inv Invalidation) error
+	// Subscribe registers a callback to be called for events published to the bus, returning a
+	// function to unregister it.
+	Subscribe(fn func(Invalidation)) (unsubscribe func(), err error)
+}
+
+// Subscribe applies invalidations published to the cache's Bus by other caches to this cache,
+// until the returned function is called. The removals are not published again.
+func (p *Cache) Subscribe() (unsubscribe func(), err error) {
+	source := p.source()
+	return p.Bus.Subscribe(func(inv Invalidation) {
+		if inv.Source == source {
+			return
+		}
+		switch inv.Kind {
+		case KeyInvalidation:
+			p.deleteKey(inv.Key)
+		case TagInvalidation:
+			p.invalidateTag(inv.Tag)
+		}
+	})
+}
+
+func (p *Cache) publish(inv Invalidation) {
+	if p.Bus == nil {
+		return
+	}
+	inv.Source = p.source()
+	if err := p.Bus.Publish(inv); err != nil && p.OnBusError != nil {
+		p.OnBusError(err)
+	}
+}
+
+func (p *Cache) source() string {
+	p.sourceSet.Do(func() {
+		p.sourceID = randomID()
+	})
+	return p.sourceID
+}
+
+func randomID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// LocalBus is an InvalidationBus for caches within the same process. Events are delivered to the
+// subscribers synchronously during Publish.
+type LocalBus struct {
+	mu   sync.RWMutex
+	subs map[*func(Invalidation)]struct{}
+}
+
+// Publish calls all the subscribed callbacks with the event.
+func (b *LocalBus) Publish(inv Invalidation) error {
+	b.mu.RLock()
+	subs := make([]func(Invalidation), 0, len(b.subs))
+	for fn := range b.subs {
+		subs = append(subs, *fn)
+	}
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		fn(inv)
+	}
+	return nil
+}
+
+// Subscribe registers the callback to be called by Publish.
+func (b *LocalBus) Subscribe(fn func(Invalidation)) (func(), error) {
+	sub := &fn
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*func(Invalidation)]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, sub)
+		b.mu.Unlock()
+	}, nil
+}
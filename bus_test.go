@@ -0,0 +1,35 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestLocalBus_Delete_RemovesFromSubscribedCache(t *testing.T) {
+	var bus grouped.LocalBus
+	first := grouped.Cache{Bus: &bus}
+	second := grouped.Cache{Bus: &bus}
+	if _, err := second.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	first.Set("key", "value")
+	second.Set("key", "value")
+	first.Delete("key")
+	if _, ok := second.Peek("key"); ok {
+		t.Fatal("Expected key to be removed from subscribed cache")
+	}
+}
+
+func TestLocalBus_Delete_RemovesEmptyKey(t *testing.T) {
+	var bus grouped.LocalBus
+	first := grouped.Cache{Bus: &bus}
+	second := grouped.Cache{Bus: &bus}
+	if _, err := second.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	second.Set("", "value")
+	first.Delete("")
+	if _, ok := second.Peek(""); ok {
+		t.Fatal("Expected empty key to be removed from subscribed cache")
+	}
+}
@@ -1,16 +1,141 @@
 package grouped
 
 import (
+	"container/list"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Cache shares the results of all calls with the same key, executing only one of the callbacks
 // in the group to build the result if necessary.
 type Cache struct {
+	// If set, accepted results are removed from the cache once they have been cached for the given
+	// duration, forcing them to be re-built the next time they are retrieved.
+	TTL time.Duration
+	// If set, results that the callback indicates should not be accepted are cached for the given
+	// duration. Until the failure expires, the members of the group and any later calls for the
+	// same key receive the failed result with status Failed instead of invoking another callback.
+	FailureTTL time.Duration
+	// If set, the callback is called for every value removed from the cache, after the removal and
+	// without holding any lock on the cache. Cached failures are removed without calling it.
+	OnRemove func(key string, value interface{}, reason RemoveReason)
+	// If set, the total cost of the values in the cache is kept at or below MaxCost by evicting the
+	// least recently used values when a new value is stored.
+	MaxCost int64
+	// Computes the cost of a value for MaxCost. If not set, each value has a cost of 1. Cached
+	// failures have no cost.
+	Cost func(key string, value interface{}) int64
+	// If set, values whose cost is larger than MaxCost are returned to the group without being
+	// cached. Otherwise, such a value evicts all other values and is cached on its own.
+	RejectOversized bool
+	// Codec used to encode values outside the process, such as by Snapshot and Restore or for the
+	// Store. Defaults to GobCodec.
+	Codec Codec
+	// If set, a value missing from the cache is retrieved from the Store before invoking a callback,
+	// and values from callbacks or Set are written to the Store. Values deleted or purged from the
+	// cache are also deleted from the Store, but evicted and expired values are not.
+	Store Store
+	// If set, a result that became stale because its key was deleted or invalidated while the
+	// callback was executing is discarded and the callback is invoked again. Otherwise the stale
+	// result is returned to the group without being cached.
+	ReloadStale bool
+	// If set, the callback is called with errors from the Store or from encoding values for it. The
+	// failed operation is otherwise ignored, as if the Store did not contain the value.
+	OnStoreError func(key string, err error)
+	// If set, Delete, DeleteUnless and InvalidateTag publish their removals to the Bus, and Subscribe
+	// applies removals published by other caches to this cache.
+	Bus InvalidationBus
+	// If set, the callback is called with errors from publishing to the Bus.
+	OnBusError func(err error)
+	// If set, values are copied using the callback when they are stored in the cache, and each
+	// retrieval of a value from the cache receives its own copy, so that callers may modify the
+	// values they receive without affecting other callers.
+	Clone func(interface{}) interface{}
+	// If set along with Clone, values are instead shared with callers without being copied, and
+	// Clone is only used to keep a private copy of each value when it is stored. Whenever the value
+	// is retrieved, it is compared with the private copy using reflect.DeepEqual, and the callback
+	// is called if they differ, indicating that a caller modified the shared value. As the
+	// comparison reads the whole value, running with the race detector also reports callers
+	// modifying the value concurrently with its retrieval.
+	OnMutation func(key string, value interface{})
+	// If set, returns the tags to attach to a value when it is stored in the cache, allowing all
+	// values with a tag to be removed using InvalidateTag. Cached failures have no tags.
+	Tags func(key string, value interface{}) []string
+
 	callgroup Calls
+	sourceID  string
+	sourceSet sync.Once
 
 	mu     sync.RWMutex
-	values map[string]interface{}
+	values map[string]*cacheEntry
+	loads  map[string]*cacheLoad
+	cost   int64
+	tagged map[string]map[string]struct{}
+
+	// The recency list of keys is guarded by a separate lock so that it can be updated by lookups
+	// holding only the read lock. It must be acquired after mu when both are held.
+	lruMu sync.Mutex
+	lru   list.List
+}
+
+type cacheEntry struct {
+	// Accessed atomically, and kept first for alignment.
+	hits       int64
+	lastAccess int64
+
+	created      time.Time
+	loadDuration time.Duration
+
+	value   interface{}
+	private interface{}
+	err     error
+	failed  bool
+	expires time.Time
+	cost    int64
+	tags    []string
+	elem    *list.Element
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (e *cacheEntry) info(key string) Entry {
+	info := Entry{
+		Key:          key,
+		Value:        e.value,
+		Created:      e.created,
+		Hits:         atomic.LoadInt64(&e.hits),
+		LoadDuration: e.loadDuration,
+	}
+	if lastAccess := atomic.LoadInt64(&e.lastAccess); lastAccess != 0 {
+		info.LastAccess = time.Unix(0, lastAccess)
+	}
+	return info
+}
+
+// share returns the entry's value to a caller, copying it or checking it for modifications as
+// configured by Clone and OnMutation.
+func (p *Cache) share(key string, entry *cacheEntry, value interface{}) interface{} {
+	if p.Clone == nil {
+		return value
+	}
+	if p.OnMutation == nil {
+		return p.Clone(value)
+	}
+	if entry.private != nil && !reflect.DeepEqual(value, entry.private) {
+		p.OnMutation(key, value)
+	}
+	return value
+}
+
+func (e *cacheEntry) result(status Status) (interface{}, Status) {
+	if e.failed {
+		return e.value, Failed
+	}
+	return e.value, status
 }
 
 // Get retrieves the existing value for the key if present. If not, it starts or joins the call
@@ -19,61 +144,462 @@ type Cache struct {
 // result should not be accepted, a different member's callback will be invoked for the group, and
 // so on until an invoked callback completes successfully. A cancel channel may be provided,
 // allowing a caller to leave the group before the result is ready.
+// If FailureTTL is set, a result that should not be accepted is instead shared with the group and
+// cached, and returned with status Failed.
 func (p *Cache) Get(key string, cancel <-chan struct{}, get func() (interface{}, bool)) (interface{}, Status) {
-	p.mu.RLock()
-	if val, ok := p.values[key]; ok {
-		p.mu.RUnlock()
-		return val, Shared
+	entry, status := p.get(key, cancel, func() (*cacheEntry, bool) {
+		val, accept := get()
+		if !accept && p.FailureTTL <= 0 {
+			return &cacheEntry{value: val}, false
+		}
+		entry := &cacheEntry{value: val, failed: !accept}
+		if ttl := p.ttl(entry); ttl > 0 {
+			entry.expires = time.Now().Add(ttl)
+		}
+		return entry, true
+	})
+	if status == Canceled {
+		if entry == nil {
+			return nil, Canceled
+		}
+		return entry.value, Canceled
+	}
+	value, status := entry.result(status)
+	return p.share(key, entry, value), status
+}
+
+// get returns the cached entry for the key, or builds it using the callback within the key's call
+// group. Entries built with an error are shared with the group but not cached. If the cache has a
+// Store, it is consulted before building the entry, and built entries are written back to it.
+func (p *Cache) get(key string, cancel <-chan struct{}, build func() (*cacheEntry, bool)) (*cacheEntry, Status) {
+	if entry := p.lookup(key); entry != nil {
+		return entry, Shared
 	}
-	p.mu.RUnlock()
 
-	return p.callgroup.Do(key, cancel, func() (interface{}, bool) {
-		p.mu.RLock()
-		if val, ok := p.values[key]; ok {
-			p.mu.RUnlock()
-			return val, true
+	result, status := p.callgroup.Do(key, cancel, func() (interface{}, bool) {
+		if entry := p.lookup(key); entry != nil {
+			return entry, true
 		}
-		p.mu.RUnlock()
-		val, accept := get()
-		if !accept {
-			return val, false
+		for {
+			entry, accept, stale := p.fill(key, build)
+			if !stale || !p.ReloadStale {
+				return entry, accept
+			}
 		}
-		p.mu.Lock()
-		if p.values == nil {
-			p.values = make(map[string]interface{})
+	})
+	entry, _ := result.(*cacheEntry)
+	return entry, status
+}
+
+// fill builds the entry for the key and stores it in the cache, unless the key was deleted or
+// invalidated while the entry was being built, in which case the entry is stale and is not stored.
+// Must be called by the leader of the key's call group.
+func (p *Cache) fill(key string, build func() (*cacheEntry, bool)) (entry *cacheEntry, accept bool, stale bool) {
+	load := p.beginLoad(key)
+	defer p.endLoad(key, load)
+
+	if entry = p.load(key); entry != nil {
+		return entry, true, p.commit(key, load, entry, false)
+	}
+	start := time.Now()
+	entry, accept = build()
+	if !accept || entry.err != nil {
+		return entry, accept, false
+	}
+	entry.loadDuration = time.Since(start)
+	return entry, true, p.commit(key, load, entry, true)
+}
+
+// beginLoad starts tracking deletions and invalidations of the key while its entry is being built.
+func (p *Cache) beginLoad(key string) *cacheLoad {
+	load := &cacheLoad{}
+	p.mu.Lock()
+	if p.loads == nil {
+		p.loads = make(map[string]*cacheLoad)
+	}
+	p.loads[key] = load
+	p.mu.Unlock()
+	return load
+}
+
+func (p *Cache) endLoad(key string, load *cacheLoad) {
+	p.mu.Lock()
+	if p.loads[key] == load {
+		delete(p.loads, key)
+	}
+	p.mu.Unlock()
+}
+
+// commit stores the built entry in the cache, and in the Store if save is set, unless the load has
+// become stale. Stale entries are not written to the Store, so that they do not replace values
+// written by the change that made them stale.
+func (p *Cache) commit(key string, load *cacheLoad, entry *cacheEntry, save bool) (stale bool) {
+	value := entry.value
+	p.prepare(key, entry)
+
+	var removed []cacheRemoval
+	p.mu.Lock()
+	stale = load.stale(entry.tags)
+	if !stale {
+		removed = p.store(key, entry)
+	}
+	p.mu.Unlock()
+	p.notify(removed...)
+	if !stale && save && !entry.failed {
+		p.save(key, value)
+	}
+	return stale
+}
+
+// cacheLoad tracks the deletions and invalidations affecting an entry while it is being built.
+type cacheLoad struct {
+	deleted bool
+	tags    []string
+}
+
+func (l *cacheLoad) stale(tags []string) bool {
+	if l.deleted {
+		return true
+	}
+	for _, invalidated := range l.tags {
+		for _, tag := range tags {
+			if tag == invalidated {
+				return true
+			}
 		}
-		p.values[key] = val
-		p.mu.Unlock()
-		return val, true
+	}
+	return false
+}
+
+// invalidateLoads marks any entry for the key being built as stale. Must be called with the write
+// lock held.
+func (p *Cache) invalidateLoads(key string) {
+	if load := p.loads[key]; load != nil {
+		load.deleted = true
+	}
+}
+
+func (p *Cache) lookup(key string) *cacheEntry {
+	p.mu.RLock()
+	entry, ok := p.values[key]
+	p.mu.RUnlock()
+	now := time.Now()
+	if !ok || entry.expired(now) {
+		return nil
+	}
+	atomic.AddInt64(&entry.hits, 1)
+	atomic.StoreInt64(&entry.lastAccess, now.UnixNano())
+	p.lruMu.Lock()
+	if entry.elem != nil {
+		p.lru.MoveToFront(entry.elem)
+	}
+	p.lruMu.Unlock()
+	return entry
+}
+
+// prepare copies the value, and sets the cost and tags of the entry, before it is stored. Must be
+// called without holding any lock on the cache.
+func (p *Cache) prepare(key string, entry *cacheEntry) {
+	if p.Clone != nil {
+		if p.OnMutation == nil {
+			entry.value = p.Clone(entry.value)
+		} else {
+			entry.private = p.Clone(entry.value)
+		}
+	}
+	if entry.failed {
+		return
+	}
+	if p.MaxCost > 0 {
+		if p.Cost == nil {
+			entry.cost = 1
+		} else {
+			entry.cost = p.Cost(key, entry.value)
+		}
+	}
+	if p.Tags != nil {
+		entry.tags = p.Tags(key, entry.value)
+	}
+}
+
+func (p *Cache) ttl(entry *cacheEntry) time.Duration {
+	if entry.failed {
+		return p.FailureTTL
+	}
+	return p.TTL
+}
+
+// Set stores the value for the key in the cache without invoking a callback, replacing any existing
+// entry for the key. The value expires after TTL if set, and is written to the Store if set.
+func (p *Cache) Set(key string, value interface{}) {
+	entry := &cacheEntry{value: value}
+	if p.TTL > 0 {
+		entry.expires = time.Now().Add(p.TTL)
+	}
+	p.prepare(key, entry)
+	p.mu.Lock()
+	p.invalidateLoads(key)
+	removed := p.store(key, entry)
+	p.mu.Unlock()
+	p.notify(removed...)
+	p.save(key, value)
+}
+
+// Peek retrieves the existing value for the key if present, without invoking a callback or joining
+// the key's call group. Cached failures are not returned.
+func (p *Cache) Peek(key string) (interface{}, bool) {
+	entry := p.lookup(key)
+	if entry == nil || entry.failed {
+		return nil, false
+	}
+	return p.share(key, entry, entry.value), true
+}
+
+// Len returns the number of values in the cache, not counting cached failures or expired entries.
+func (p *Cache) Len() int {
+	n := 0
+	p.rangeEntries(func(string, *cacheEntry) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Keys returns the keys of all values in the cache, not including cached failures or expired
+// entries. The keys are returned in no particular order.
+func (p *Cache) Keys() []string {
+	var keys []string
+	p.rangeEntries(func(key string, _ *cacheEntry) bool {
+		keys = append(keys, key)
+		return true
 	})
+	return keys
+}
+
+// Range calls the callback for each value in the cache until the callback returns false, not
+// including cached failures or expired entries. The callback is called on a snapshot of the cache's
+// entries taken before the first call, and without holding any lock on the cache, so it may call
+// the cache's other methods.
+func (p *Cache) Range(fn func(key string, value interface{}) bool) {
+	p.rangeEntries(func(key string, entry *cacheEntry) bool {
+		return fn(key, p.share(key, entry, entry.value))
+	})
+}
+
+// rangeEntries calls the callback for a snapshot of the cache's values, as described for Range.
+func (p *Cache) rangeEntries(fn func(key string, entry *cacheEntry) bool) {
+	type record struct {
+		key   string
+		entry *cacheEntry
+	}
+	now := time.Now()
+	p.mu.RLock()
+	snapshot := make([]record, 0, len(p.values))
+	for key, entry := range p.values {
+		if entry.failed || entry.expired(now) {
+			continue
+		}
+		snapshot = append(snapshot, record{key: key, entry: entry})
+	}
+	p.mu.RUnlock()
+
+	for _, rec := range snapshot {
+		if !fn(rec.key, rec.entry) {
+			return
+		}
+	}
 }
 
 // Delete removes the given key from the cache's entries if present, forcing the removed entry to be
-// re-built the next time it is retrieved.
+// re-built the next time it is retrieved. If the entry is being built, the result is stale and is
+// not cached, as described for ReloadStale.
 func (p *Cache) Delete(key string) {
+	p.deleteKey(key)
+	p.publish(Invalidation{Kind: KeyInvalidation, Key: key})
+}
+
+func (p *Cache) deleteKey(key string) {
 	p.mu.Lock()
-	delete(p.values, key)
+	p.invalidateLoads(key)
+	removed := p.remove(key, Deleted)
 	p.mu.Unlock()
+	p.notify(removed...)
+	if p.Store != nil {
+		if err := p.Store.Delete(key); err != nil {
+			p.storeError(key, err)
+		}
+	}
 }
 
 // Delete removes the given key from the cache's entries if present and the callback returns false.
 // If removed, the key will be rebuilt the next time it is retrieved.
 func (p *Cache) DeleteUnless(key string, keep func(interface{}) bool) {
+	p.DeleteUnlessEntry(key, func(entry Entry) bool {
+		return keep(entry.Value)
+	})
+}
+
+// DeleteUnlessEntry is like DeleteUnless, but the callback receives the entry's information along
+// with its value.
+func (p *Cache) DeleteUnlessEntry(key string, keep func(Entry) bool) {
+	var removed []cacheRemoval
+	defer func() {
+		p.notify(removed...)
+		p.unsave(removed...)
+		if len(removed) > 0 {
+			p.publish(Invalidation{Kind: KeyInvalidation, Key: key})
+		}
+	}()
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if val, ok := p.values[key]; ok && !keep(val) {
-		delete(p.values, key)
+	if entry, ok := p.values[key]; ok && !keep(entry.info(key)) {
+		p.invalidateLoads(key)
+		removed = p.remove(key, Deleted)
 	}
 }
 
 // Purge removes any items from the cache where the callback returns false, forcing the removed
 // entries to be re-built the next time they are retrieved.
 func (p *Cache) Purge(keep func(interface{}) bool) {
+	p.PurgeEntries(func(entry Entry) bool {
+		return keep(entry.Value)
+	})
+}
+
+// PurgeEntries is like Purge, but the callback receives each entry's information along with its
+// value.
+func (p *Cache) PurgeEntries(keep func(Entry) bool) {
+	var removed []cacheRemoval
+	defer func() {
+		p.notify(removed...)
+		p.unsave(removed...)
+	}()
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	for key, val := range p.values {
-		if !keep(val) {
-			delete(p.values, key)
+	for key, entry := range p.values {
+		if !keep(entry.info(key)) {
+			removed = append(removed, p.remove(key, Purged)...)
+		}
+	}
+}
+
+// InvalidateTag removes all values with the given tag from the cache, forcing the removed entries to
+// be re-built the next time they are retrieved.
+func (p *Cache) InvalidateTag(tag string) {
+	p.invalidateTag(tag)
+	p.publish(Invalidation{Kind: TagInvalidation, Tag: tag})
+}
+
+func (p *Cache) invalidateTag(tag string) {
+	var removed []cacheRemoval
+	p.mu.Lock()
+	for _, load := range p.loads {
+		load.tags = append(load.tags, tag)
+	}
+	for key := range p.tagged[tag] {
+		removed = append(removed, p.remove(key, Deleted)...)
+	}
+	p.mu.Unlock()
+	p.notify(removed...)
+	p.unsave(removed...)
+}
+
+// RemoveReason describes why a value was removed from a Cache.
+type RemoveReason int
+
+const (
+	// The value was removed by Delete, DeleteUnless or InvalidateTag.
+	Deleted RemoveReason = iota
+	// The value was removed by Purge.
+	Purged
+	// The value was replaced by a new value for the same key.
+	Replaced
+	// The value was removed because its TTL elapsed.
+	Expired
+	// The value was removed to make space for other values.
+	Evicted
+)
+
+type cacheRemoval struct {
+	key    string
+	entry  *cacheEntry
+	reason RemoveReason
+}
+
+// store puts the entry in the cache, returning the replaced and evicted entries if any. An oversized
+// entry is not stored if RejectOversized is set, but still replaces the previous entry for the key.
+// Must be called with the write lock held.
+func (p *Cache) store(key string, entry *cacheEntry) []cacheRemoval {
+	removed := p.remove(key, Replaced)
+	if p.MaxCost > 0 && entry.cost > p.MaxCost && p.RejectOversized {
+		return removed
+	}
+
+	if p.values == nil {
+		p.values = make(map[string]*cacheEntry)
+	}
+	entry.created = time.Now()
+	p.values[key] = entry
+	p.cost += entry.cost
+	for _, tag := range entry.tags {
+		if p.tagged == nil {
+			p.tagged = make(map[string]map[string]struct{})
+		}
+		if p.tagged[tag] == nil {
+			p.tagged[tag] = make(map[string]struct{})
+		}
+		p.tagged[tag][key] = struct{}{}
+	}
+	p.lruMu.Lock()
+	entry.elem = p.lru.PushFront(key)
+	p.lruMu.Unlock()
+
+	for p.MaxCost > 0 && p.cost > p.MaxCost {
+		p.lruMu.Lock()
+		oldest := p.lru.Back()
+		p.lruMu.Unlock()
+		if oldest == entry.elem {
+			break
+		}
+		removed = append(removed, p.remove(oldest.Value.(string), Evicted)...)
+	}
+	return removed
+}
+
+// remove deletes the key from the cache, returning the removed entry if any. Must be called with the
+// write lock held.
+func (p *Cache) remove(key string, reason RemoveReason) []cacheRemoval {
+	entry, ok := p.values[key]
+	if !ok {
+		return nil
+	}
+	delete(p.values, key)
+	p.cost -= entry.cost
+	for _, tag := range entry.tags {
+		delete(p.tagged[tag], key)
+		if len(p.tagged[tag]) == 0 {
+			delete(p.tagged, tag)
+		}
+	}
+	p.lruMu.Lock()
+	p.lru.Remove(entry.elem)
+	entry.elem = nil
+	p.lruMu.Unlock()
+	if entry.expired(time.Now()) {
+		reason = Expired
+	}
+	return []cacheRemoval{{key: key, entry: entry, reason: reason}}
+}
+
+// notify calls the OnRemove callback for the removed entries. Must be called without holding any
+// lock on the cache.
+func (p *Cache) notify(removed ...cacheRemoval) {
+	if p.OnRemove == nil {
+		return
+	}
+	for _, rem := range removed {
+		if !rem.entry.failed {
+			p.OnRemove(rem.key, rem.entry.value, rem.reason)
 		}
 	}
 }
@@ -3,6 +3,7 @@ package grouped_test
 import (
 	"github.com/devnev/go-grouped"
 	"testing"
+	"time"
 )
 
 func TestCache_Get(t *testing.T) {
@@ -16,3 +17,152 @@ func TestCache_Get(t *testing.T) {
 		t.Fatalf("Expected 1 call to callback, got %d", called)
 	}
 }
+
+func TestCache_Get_CachesFailureForFailureTTL(t *testing.T) {
+	pool := grouped.Cache{FailureTTL: time.Minute}
+	called := 0
+	get := func() (interface{}, bool) {
+		called++
+		return "failed", false
+	}
+	for i := 0; i < 2; i++ {
+		val, status := pool.Get("", nil, get)
+		if val != "failed" || status != grouped.Failed {
+			t.Fatalf("Expected cached failure, got %v with status %v", val, status)
+		}
+	}
+	if called != 1 {
+		t.Fatalf("Expected 1 call to callback, got %d", called)
+	}
+}
+
+func TestCache_Set_StoresValueForGet(t *testing.T) {
+	var pool grouped.Cache
+	pool.Set("key", "value")
+	if val, ok := pool.Peek("key"); !ok || val != "value" {
+		t.Fatalf("Expected value from Peek, got %v", val)
+	}
+	val, _ := pool.Get("key", nil, func() (interface{}, bool) {
+		t.Fatal("Unexpected call to callback")
+		return nil, false
+	})
+	if val != "value" {
+		t.Fatalf("Expected value from Get, got %v", val)
+	}
+	if n := pool.Len(); n != 1 {
+		t.Fatalf("Expected 1 entry, got %d", n)
+	}
+}
+
+func TestCache_Delete_CallsOnRemove(t *testing.T) {
+	var removed []grouped.RemoveReason
+	pool := grouped.Cache{OnRemove: func(key string, value interface{}, reason grouped.RemoveReason) {
+		removed = append(removed, reason)
+	}}
+	pool.Set("key", 1)
+	pool.Set("key", 2)
+	pool.Delete("key")
+	if len(removed) != 2 || removed[0] != grouped.Replaced || removed[1] != grouped.Deleted {
+		t.Fatalf("Expected Replaced and Deleted removals, got %v", removed)
+	}
+}
+
+func TestCache_Set_EvictsLeastRecentlyUsedOverMaxCost(t *testing.T) {
+	pool := grouped.Cache{MaxCost: 2}
+	pool.Set("a", 1)
+	pool.Set("b", 2)
+	pool.Peek("a")
+	pool.Set("c", 3)
+	if _, ok := pool.Peek("b"); ok {
+		t.Fatal("Expected least recently used value to be evicted")
+	}
+	if n := pool.Len(); n != 2 {
+		t.Fatalf("Expected 2 entries, got %d", n)
+	}
+}
+
+func TestCache_InvalidateTag_RemovesTaggedValues(t *testing.T) {
+	pool := grouped.Cache{Tags: func(key string, value interface{}) []string {
+		return []string{"tag:" + value.(string)}
+	}}
+	pool.Set("a", "x")
+	pool.Set("b", "x")
+	pool.Set("c", "y")
+	pool.InvalidateTag("tag:x")
+	if keys := pool.Keys(); len(keys) != 1 || keys[0] != "c" {
+		t.Fatalf("Expected only untagged key to remain, got %v", keys)
+	}
+}
+
+func TestCache_Delete_DuringGetDiscardsStaleResult(t *testing.T) {
+	var pool grouped.Cache
+	val, status := pool.Get("key", nil, func() (interface{}, bool) {
+		pool.Delete("key")
+		return "stale", true
+	})
+	if val != "stale" || status != grouped.Exclusive {
+		t.Fatalf("Expected stale result to be returned, got %v with status %v", val, status)
+	}
+	if _, ok := pool.Peek("key"); ok {
+		t.Fatal("Expected stale result not to be cached")
+	}
+}
+
+func TestCache_PurgeEntries_ReceivesHitCount(t *testing.T) {
+	var pool grouped.Cache
+	pool.Set("hot", 1)
+	pool.Set("cold", 2)
+	pool.Peek("hot")
+	pool.PurgeEntries(func(entry grouped.Entry) bool {
+		return entry.Hits > 0
+	})
+	if keys := pool.Keys(); len(keys) != 1 || keys[0] != "hot" {
+		t.Fatalf("Expected only accessed key to remain, got %v", keys)
+	}
+}
+
+func TestCache_Clone_IsolatesCallers(t *testing.T) {
+	pool := grouped.Cache{Clone: func(v interface{}) interface{} {
+		return append([]int(nil), v.([]int)...)
+	}}
+	pool.Set("key", []int{1})
+	first, _ := pool.Peek("key")
+	first.([]int)[0] = 2
+	if second, _ := pool.Peek("key"); second.([]int)[0] != 1 {
+		t.Fatalf("Expected unmodified copy, got %v", second)
+	}
+}
+
+func TestCache_Len_DoesNotCloneValues(t *testing.T) {
+	clones := 0
+	pool := grouped.Cache{Clone: func(v interface{}) interface{} {
+		clones++
+		return v
+	}}
+	pool.Set("a", 1)
+	pool.Set("b", 2)
+	clones = 0
+	if n, keys := pool.Len(), pool.Keys(); n != 2 || len(keys) != 2 {
+		t.Fatalf("Expected 2 values, got %d and %v", n, keys)
+	}
+	if clones != 0 {
+		t.Fatalf("Expected no clones, got %d", clones)
+	}
+}
+
+func TestCache_OnMutation_DetectsModifiedValue(t *testing.T) {
+	mutated := 0
+	pool := grouped.Cache{
+		Clone: func(v interface{}) interface{} {
+			return append([]int(nil), v.([]int)...)
+		},
+		OnMutation: func(string, interface{}) { mutated++ },
+	}
+	pool.Set("key", []int{1})
+	first, _ := pool.Peek("key")
+	first.([]int)[0] = 2
+	pool.Peek("key")
+	if mutated != 1 {
+		t.Fatalf("Expected 1 call to OnMutation, got %d", mutated)
+	}
+}
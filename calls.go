@@ -5,6 +5,10 @@ import "sync"
 // Calls allows batching together calls with the same key to share the result of executing only
 // one of the callbacks in the batch.
 type Calls struct {
+	// If set, each member of a group receives its own copy of the shared result, made using the
+	// callback, so that members may modify their results without affecting other members.
+	Clone func(interface{}) interface{}
+
 	mu     sync.Mutex
 	groups map[string]*callGroupInner
 }
@@ -15,7 +19,18 @@ type Calls struct {
 // invoked for the group, and so on until an invoked callback completes successfully.
 // A cancel channel may be provided, allowing a caller to leave the group before the result is ready.
 func (g *Calls) Do(key string, cancel <-chan struct{}, do func() (result interface{}, accept bool)) (interface{}, Status) {
+	result, status := g.wait(key, g.join(key), cancel, do)
+	if g.Clone != nil && status != Canceled {
+		result = g.Clone(result)
+	}
+	return result, status
+}
+
+// join starts or joins the call group for the given key. The caller must then either wait for the
+// group, or take the group's leadership and complete or release it.
+func (g *Calls) join(key string) *callGroupInner {
 	g.mu.Lock()
+	defer g.mu.Unlock()
 	if g.groups == nil {
 		g.groups = make(map[string]*callGroupInner)
 	}
@@ -28,8 +43,12 @@ func (g *Calls) Do(key string, cancel <-chan struct{}, do func() (result interfa
 	}
 	inner := g.groups[key]
 	inner.monitors++
-	g.mu.Unlock()
+	return inner
+}
 
+// wait waits for the result of a joined group, invoking the callback if this member becomes the
+// group's leader.
+func (g *Calls) wait(key string, inner *callGroupInner, cancel <-chan struct{}, do func() (interface{}, bool)) (interface{}, Status) {
 	select {
 	case <-cancel:
 		g.mu.Lock()
@@ -47,15 +66,20 @@ func (g *Calls) Do(key string, cancel <-chan struct{}, do func() (result interfa
 	accepted := false
 	defer func() {
 		if !accepted {
-			inner.leader <- struct{}{}
+			inner.release()
 		}
 	}()
 	if result, accept := do(); !accept {
 		return result, Canceled
 	} else {
-		inner.result = result
+		accepted = true
+		return result, g.complete(key, inner, result)
 	}
-	accepted = true
+}
+
+// complete shares the result with the members of the group, which must be led by the caller.
+func (g *Calls) complete(key string, inner *callGroupInner, result interface{}) Status {
+	inner.result = result
 
 	g.mu.Lock()
 	delete(g.groups, key)
@@ -63,9 +87,9 @@ func (g *Calls) Do(key string, cancel <-chan struct{}, do func() (result interfa
 
 	close(inner.done)
 	if inner.monitors > 1 {
-		return inner.result, Shared
+		return Shared
 	} else {
-		return inner.result, Exclusive
+		return Exclusive
 	}
 }
 
@@ -75,3 +99,18 @@ type callGroupInner struct {
 	result   interface{}
 	monitors int
 }
+
+// tryLead takes the leadership of the group if no other member holds it.
+func (i *callGroupInner) tryLead() bool {
+	select {
+	case <-i.leader:
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives up the leadership of the group so that another member may invoke its callback.
+func (i *callGroupInner) release() {
+	i.leader <- struct{}{}
+}
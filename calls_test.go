@@ -16,3 +16,15 @@ func TestCalls_Do_CallsCallbackOnce(t *testing.T) {
 		t.Fatalf("Expected 1 call to callback, got %d", called)
 	}
 }
+
+func TestCalls_Do_ClonesResult(t *testing.T) {
+	calls := grouped.Calls{Clone: func(v interface{}) interface{} {
+		return v.(int) + 1
+	}}
+	val, _ := calls.Do("", nil, func() (interface{}, bool) {
+		return 1, true
+	})
+	if val != 2 {
+		t.Fatalf("Expected cloned result, got %v", val)
+	}
+}
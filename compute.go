@@ -0,0 +1,75 @@
+package grouped
+
+import "time"
+
+// Compute atomically replaces the value for the key with the result of the callback, which receives
+// the existing value if present. The callback is executed as a member of the key's call group, so
+// it is serialized with any callback building the value through Get and with other calls to
+// Compute for the key. If the callback returns keep=false, the value is deleted from the cache.
+// If the key is set, deleted or invalidated while the callback runs, the callback is invoked again
+// with the current value, so that the concurrent change is not lost.
+// Calls to Get waiting for the key receive the computed value, or invoke their own callbacks if the
+// value was deleted.
+func (p *Cache) Compute(key string, fn func(old interface{}, exists bool) (new interface{}, keep bool)) (interface{}, bool) {
+	for {
+		var value interface{}
+		var keep, computed bool
+		p.callgroup.Do(key, nil, func() (interface{}, bool) {
+			for {
+				var entry *cacheEntry
+				var stale bool
+				value, entry, stale = p.compute(key, fn)
+				if stale {
+					continue
+				}
+				computed, keep = true, entry != nil
+				return entry, keep
+			}
+		})
+		if computed {
+			return value, keep
+		}
+	}
+}
+
+// compute invokes the callback for Compute once, storing the result or deleting the key unless the
+// key was changed while the callback ran. Returns the callback's value along with the stored entry,
+// which is nil if the key was deleted. Must be called by the leader of the key's call group.
+func (p *Cache) compute(key string, fn func(interface{}, bool) (interface{}, bool)) (value interface{}, entry *cacheEntry, stale bool) {
+	load := p.beginLoad(key)
+	defer p.endLoad(key, load)
+
+	var old interface{}
+	exists := false
+	if entry := p.lookup(key); entry != nil && !entry.failed {
+		old, exists = p.share(key, entry, entry.value), true
+	}
+	start := time.Now()
+	value, keep := fn(old, exists)
+	if keep {
+		entry = &cacheEntry{value: value, loadDuration: time.Since(start)}
+		if p.TTL > 0 {
+			entry.expires = time.Now().Add(p.TTL)
+		}
+		return value, entry, p.commit(key, load, entry, true)
+	}
+
+	p.mu.Lock()
+	stale = load.stale(nil)
+	var removed []cacheRemoval
+	if !stale {
+		removed = p.remove(key, Deleted)
+	}
+	p.mu.Unlock()
+	if stale {
+		return value, nil, true
+	}
+	p.notify(removed...)
+	if p.Store != nil {
+		if err := p.Store.Delete(key); err != nil {
+			p.storeError(key, err)
+		}
+	}
+	p.publish(Invalidation{Kind: KeyInvalidation, Key: key})
+	return value, nil, false
+}
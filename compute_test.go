@@ -0,0 +1,63 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"sync"
+	"testing"
+)
+
+func TestCache_Compute_SerializesUpdates(t *testing.T) {
+	var pool grouped.Cache
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.Compute("counter", func(old interface{}, exists bool) (interface{}, bool) {
+				if !exists {
+					return 1, true
+				}
+				return old.(int) + 1, true
+			})
+		}()
+	}
+	wg.Wait()
+	if val, _ := pool.Peek("counter"); val != 100 {
+		t.Fatalf("Expected counter to be 100, got %v", val)
+	}
+}
+
+func TestCache_Compute_RecomputesAfterConcurrentSet(t *testing.T) {
+	var pool grouped.Cache
+	pool.Set("key", 1)
+	var seen []interface{}
+	val, _ := pool.Compute("key", func(old interface{}, exists bool) (interface{}, bool) {
+		seen = append(seen, old)
+		if len(seen) == 1 {
+			pool.Set("key", 100)
+		}
+		return old.(int) + 1, true
+	})
+	if len(seen) != 2 || seen[1] != 100 {
+		t.Fatalf("Expected callback to be invoked again with the new value, got %v", seen)
+	}
+	if stored, _ := pool.Peek("key"); val != 101 || stored != 101 {
+		t.Fatalf("Expected 101 to be returned and stored, got %v and %v", val, stored)
+	}
+}
+
+func TestCache_Compute_RecomputesAfterConcurrentDelete(t *testing.T) {
+	var pool grouped.Cache
+	pool.Set("key", 1)
+	calls := 0
+	pool.Compute("key", func(old interface{}, exists bool) (interface{}, bool) {
+		calls++
+		if calls == 1 {
+			pool.Delete("key")
+		}
+		return old, exists
+	})
+	if _, ok := pool.Peek("key"); ok || calls != 2 {
+		t.Fatalf("Expected key to stay deleted after 2 calls, got %d calls", calls)
+	}
+}
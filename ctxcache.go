@@ -0,0 +1,62 @@
+package grouped
+
+import (
+	"context"
+	"time"
+)
+
+// CtxCache shares the results of all calls with the same key, executing only one of the callbacks
+// in the group to build the result if necessary. Unlike Cache, the callbacks take a context and
+// may fail with an error, which is returned to the group but never cached.
+type CtxCache struct {
+	// If set, results are removed from the cache once they have been cached for the given duration,
+	// forcing them to be re-built the next time they are retrieved.
+	TTL time.Duration
+	// If set, each call receives its own copy of the cached value, made using the callback, so that
+	// callers may modify the values they receive without affecting other callers. Values returned
+	// with an error are not copied.
+	Clone func(interface{}) interface{}
+
+	cache Cache
+}
+
+// Get retrieves the existing value for the key if present. If not, it starts or joins the call
+// group for the given key, waiting for a member of the group to complete its callback. If the
+// callback returns an error, the error is returned to all members of the group and the value is
+// not cached. If the executed callback panics or its context is done, a different member's
+// callback will be invoked for the group, and so on until an invoked callback completes.
+func (c *CtxCache) Get(ctx context.Context, key string, get func(context.Context) (interface{}, error)) (interface{}, Status, error) {
+	entry, status := c.cache.get(key, ctx.Done(), func() (*cacheEntry, bool) {
+		val, err := get(ctx)
+		entry := &cacheEntry{value: val, err: err}
+		if c.TTL > 0 {
+			entry.expires = time.Now().Add(c.TTL)
+		}
+		return entry, ctx.Err() == nil
+	})
+	if status == Canceled {
+		return nil, Canceled, ctx.Err()
+	}
+	if c.Clone != nil && entry.err == nil {
+		return c.Clone(entry.value), status, nil
+	}
+	return entry.value, status, entry.err
+}
+
+// Delete removes the given key from the cache's entries if present, forcing the removed entry to be
+// re-built the next time it is retrieved.
+func (c *CtxCache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// DeleteUnless removes the given key from the cache's entries if present and the callback returns
+// false. If removed, the key will be rebuilt the next time it is retrieved.
+func (c *CtxCache) DeleteUnless(key string, keep func(interface{}) bool) {
+	c.cache.DeleteUnless(key, keep)
+}
+
+// Purge removes any items from the cache where the callback returns false, forcing the removed
+// entries to be re-built the next time they are retrieved.
+func (c *CtxCache) Purge(keep func(interface{}) bool) {
+	c.cache.Purge(keep)
+}
@@ -0,0 +1,25 @@
+package grouped_test
+
+import (
+	"context"
+	"errors"
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestCtxCache_Get_DoesNotCacheErrors(t *testing.T) {
+	var cache grouped.CtxCache
+	called := 0
+	get := func(context.Context) (interface{}, error) {
+		called++
+		return nil, errors.New("failed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := cache.Get(context.Background(), "", get); err == nil {
+			t.Fatal("Expected error from callback")
+		}
+	}
+	if called != 2 {
+		t.Fatalf("Expected 2 calls to callback, got %d", called)
+	}
+}
@@ -5,6 +5,11 @@ import "context"
 // CtxCalls allows batching together calls with the same key to share the result of executing
 // only one of the callbacks in the batch.
 type CtxCalls struct {
+	// If set, each member of a group receives its own copy of the shared result, made using the
+	// callback, so that members may modify their results without affecting other members. Results
+	// returned with an error are not copied.
+	Clone func(interface{}) interface{}
+
 	callGroup Calls
 }
 
@@ -21,6 +26,9 @@ func (g *CtxCalls) Do(ctx context.Context, key string, do func() (interface{}, e
 		return nil, Canceled, ctx.Err()
 	}
 	res2 := res.(callResult)
+	if g.Clone != nil && res2.err == nil {
+		res2.val = g.Clone(res2.val)
+	}
 	return res2.val, grouped, res2.err
 }
 
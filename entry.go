@@ -0,0 +1,23 @@
+package grouped
+
+import "time"
+
+// Entry describes a cached value along with information about how it was built and used, allowing
+// callbacks to make decisions based on the age or popularity of entries.
+type Entry struct {
+	Key   string
+	Value interface{}
+	// The time the value was stored in the cache.
+	Created time.Time
+	// The time the value was last retrieved from the cache, or zero if it has not been retrieved.
+	LastAccess time.Time
+	// The number of times the value has been retrieved from the cache.
+	Hits int64
+	// The time taken by the callback to build the value, or zero if the value was not built by a
+	// callback.
+	LoadDuration time.Duration
+	// For RefCache, the number of references to the value held by callers, not including the
+	// cache's own reference. When validating an entry in Get, this includes the reference being
+	// acquired by the Get call.
+	Refs int
+}
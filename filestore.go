@@ -0,0 +1,83 @@
+package grouped
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStore is a Store that keeps each value in a file in a directory on the local filesystem, so
+// that the values survive restarts of the process.
+type FileStore struct {
+	// The directory to store files in. It is created if it does not exist.
+	Dir string
+}
+
+// Get reads the data for the key from its file. Expired files are removed and not returned.
+func (s *FileStore) Get(key string) ([]byte, bool, error) {
+	path := s.path(key)
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if len(contents) < 8 {
+		return nil, false, os.Remove(path)
+	}
+	if expires := int64(binary.BigEndian.Uint64(contents)); expires != 0 && time.Now().UnixNano() >= expires {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	return contents[8:], true, nil
+}
+
+// Set writes the data for the key to a temporary file, and then renames it into place so that
+// concurrent readers never see a partially written file.
+func (s *FileStore) Set(key string, data []byte, ttl time.Duration) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	contents := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(contents, uint64(expires))
+	copy(contents[8:], data)
+
+	tmp, err := ioutil.TempFile(s.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Delete removes the file for the key if it exists.
+func (s *FileStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:]))
+}
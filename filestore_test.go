@@ -0,0 +1,53 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileStore_WarmsNewCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := grouped.Cache{Store: &grouped.FileStore{Dir: dir}}
+	first.Get("key", nil, func() (interface{}, bool) {
+		return "value", true
+	})
+
+	second := grouped.Cache{Store: &grouped.FileStore{Dir: dir}}
+	val, _ := second.Get("key", nil, func() (interface{}, bool) {
+		t.Fatal("Unexpected call to callback")
+		return nil, false
+	})
+	if val != "value" {
+		t.Fatalf("Expected value from store, got %v", val)
+	}
+}
+
+func TestFileStore_KeepsSetDuringStaleLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := grouped.Cache{Store: &grouped.FileStore{Dir: dir}}
+	first.Get("key", nil, func() (interface{}, bool) {
+		first.Set("key", "new")
+		return "stale", true
+	})
+
+	second := grouped.Cache{Store: &grouped.FileStore{Dir: dir}}
+	val, _ := second.Get("key", nil, func() (interface{}, bool) {
+		t.Fatal("Unexpected call to callback")
+		return nil, false
+	})
+	if val != "new" {
+		t.Fatalf("Expected value written by Set, got %v", val)
+	}
+}
@@ -0,0 +1,120 @@
+package grouped
+
+import "time"
+
+// GetMany retrieves the values for multiple keys, returning the values that were retrieved
+// successfully. Existing values are returned from the cache, and keys already being built by other
+// calls join those calls' groups as in Get. The remaining keys are passed to a single call of the
+// load callback, which returns the values it was able to build. Keys missing from its result are not
+// accepted, and another member of their groups will invoke its callback, as in Get.
+// While the load callback is executing, calls to Get for the keys being loaded join this call's
+// groups instead of invoking their own callbacks. Stale results are returned without being cached,
+// regardless of ReloadStale.
+func (p *Cache) GetMany(keys []string, cancel <-chan struct{}, load func(missing []string) map[string]interface{}) map[string]interface{} {
+	results := make(map[string]interface{}, len(keys))
+	type group struct {
+		key   string
+		inner *callGroupInner
+		load  *cacheLoad
+	}
+	var led, followed []group
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if entry := p.lookup(key); entry != nil {
+			if !entry.failed {
+				results[key] = p.share(key, entry, entry.value)
+			}
+			continue
+		}
+		inner := p.callgroup.join(key)
+		if inner.tryLead() {
+			led = append(led, group{key: key, inner: inner})
+		} else {
+			followed = append(followed, group{key: key, inner: inner})
+		}
+	}
+
+	// Groups that are still led when returning, including due to a panic in the load callback, have
+	// their leadership released so that other members can take over.
+	releaseLed := func() {
+		for _, grp := range led {
+			if grp.inner != nil {
+				grp.inner.release()
+			}
+			if grp.load != nil {
+				p.endLoad(grp.key, grp.load)
+			}
+		}
+		led = nil
+	}
+	defer releaseLed()
+	finish := func(grp *group, entry *cacheEntry) {
+		p.callgroup.complete(grp.key, grp.inner, entry)
+		grp.inner = nil
+		if !entry.failed {
+			results[grp.key] = p.share(grp.key, entry, entry.value)
+		}
+	}
+
+	var missing []string
+	for i := range led {
+		grp := &led[i]
+		if entry := p.lookup(grp.key); entry != nil {
+			finish(grp, entry)
+			continue
+		}
+		grp.load = p.beginLoad(grp.key)
+		if entry := p.load(grp.key); entry != nil {
+			p.commit(grp.key, grp.load, entry, false)
+			finish(grp, entry)
+			continue
+		}
+		missing = append(missing, grp.key)
+	}
+	if len(missing) > 0 {
+		start := time.Now()
+		loaded := load(missing)
+		loadDuration := time.Since(start)
+		for i := range led {
+			grp := &led[i]
+			if grp.inner == nil {
+				continue
+			}
+			value, ok := loaded[grp.key]
+			if !ok {
+				continue
+			}
+			entry := &cacheEntry{value: value, loadDuration: loadDuration}
+			if p.TTL > 0 {
+				entry.expires = time.Now().Add(p.TTL)
+			}
+			p.commit(grp.key, grp.load, entry, true)
+			finish(grp, entry)
+		}
+	}
+
+	releaseLed()
+
+	for _, grp := range followed {
+		key := grp.key
+		entry, status := p.callgroup.wait(key, grp.inner, cancel, func() (interface{}, bool) {
+			entry, accept, _ := p.fill(key, func() (*cacheEntry, bool) {
+				value, ok := load([]string{key})[key]
+				entry := &cacheEntry{value: value}
+				if p.TTL > 0 {
+					entry.expires = time.Now().Add(p.TTL)
+				}
+				return entry, ok
+			})
+			return entry, accept
+		})
+		if entry, ok := entry.(*cacheEntry); ok && status != Canceled && !entry.failed {
+			results[key] = p.share(key, entry, entry.value)
+		}
+	}
+	return results
+}
@@ -0,0 +1,22 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestCache_GetMany_LoadsOnlyMissingKeys(t *testing.T) {
+	var pool grouped.Cache
+	pool.Set("a", 1)
+	var loaded []string
+	results := pool.GetMany([]string{"a", "b", "c"}, nil, func(missing []string) map[string]interface{} {
+		loaded = append(loaded, missing...)
+		return map[string]interface{}{"b": 2}
+	})
+	if len(loaded) != 2 {
+		t.Fatalf("Expected 2 keys to be loaded, got %v", loaded)
+	}
+	if len(results) != 2 || results["a"] != 1 || results["b"] != 2 {
+		t.Fatalf("Expected values for a and b, got %v", results)
+	}
+}
@@ -0,0 +1,97 @@
+package grouped
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrFetchFailed is returned by GetHandle if the fetch method failed.
+	ErrFetchFailed = errors.New("grouped: fetch failed")
+	// ErrCanceled is returned by GetHandle if the call was canceled before the value was ready.
+	ErrCanceled = errors.New("grouped: canceled")
+	// ErrReleased is returned when using a Handle that has already been released.
+	ErrReleased = errors.New("grouped: handle already released")
+)
+
+// Handle is a reference to a value in a RefCache. The value is kept open until all handles and
+// other references to it have been released.
+type Handle struct {
+	mu       sync.Mutex
+	cache    *RefCache
+	key      string
+	item     *refCacheItem
+	release  func()
+	released bool
+}
+
+func (p *RefCache) newHandle(key string, item *refCacheItem) *Handle {
+	b, release := p.borrow(key, item)
+	h := &Handle{cache: p, key: key, item: item, release: release}
+	p.watchHandle(h, b)
+	return h
+}
+
+// GetHandle retrieves the value for the key like Get, returning a handle holding a reference to the
+// value. If the fetch method fails, ErrFetchFailed is returned, if the call is canceled,
+// ErrCanceled is returned, and if the cache has been closed, ErrClosed is returned.
+func (p *RefCache) GetHandle(key string, cancel <-chan struct{}, fetch func() (interface{}, func())) (*Handle, error) {
+	_, item, err := p.get(key, cancel, func() (refFetch, bool) {
+		value, closer := fetch()
+		return refFetch{value: value, closer: closer}, closer != nil
+	})
+	if item != nil {
+		return p.newHandle(key, item), nil
+	} else if err != nil {
+		return nil, err
+	}
+	select {
+	case <-cancel:
+		return nil, ErrCanceled
+	default:
+		return nil, ErrFetchFailed
+	}
+}
+
+// GetHandleCtx retrieves the value for the key like GetCtx, returning a handle holding a reference
+// to the value. If the context is done before the value is ready, the context's error is returned.
+func (p *RefCache) GetHandleCtx(ctx context.Context, key string, fetch func(context.Context) (interface{}, func(), error)) (*Handle, error) {
+	_, item, err := p.getCtx(ctx, key, fetch)
+	if item == nil {
+		return nil, err
+	}
+	return p.newHandle(key, item), nil
+}
+
+// Value returns the referenced value. The value should not be used after the handle is released.
+func (h *Handle) Value() interface{} {
+	return h.item.value
+}
+
+// Release closes the handle's reference to the value. Releasing a handle more than once has no
+// effect other than returning ErrReleased.
+func (h *Handle) Release() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return ErrReleased
+	}
+	h.released = true
+	h.release()
+	return nil
+}
+
+// Clone returns a new handle holding another reference to the value, which must be released
+// separately, such as for handing the value to another goroutine. Returns ErrReleased if the handle
+// has already been released.
+func (h *Handle) Clone() (*Handle, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return nil, ErrReleased
+	}
+	// The handle's own reference keeps the count above zero, so it can be incremented safely.
+	h.item.ref()
+	return h.cache.newHandle(h.key, h.item), nil
+}
@@ -0,0 +1,44 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestHandle_Release_ReportsDoubleRelease(t *testing.T) {
+	var pool grouped.RefCache
+	closed := 0
+	handle, err := pool.GetHandle("", nil, func() (interface{}, func()) {
+		return "value", func() { closed++ }
+	})
+	if err != nil || handle.Value() != "value" {
+		t.Fatalf("Expected handle for value, got %v", err)
+	}
+	clone, err := handle.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle.Release(); err != grouped.ErrReleased {
+		t.Fatalf("Expected ErrReleased, got %v", err)
+	}
+	if err := clone.Release(); err != nil {
+		t.Fatal(err)
+	}
+	pool.Purge(nil)
+	if closed != 1 {
+		t.Fatalf("Expected 1 call to closer, got %d", closed)
+	}
+}
+
+func TestRefCache_GetHandle_ReportsFetchFailure(t *testing.T) {
+	var pool grouped.RefCache
+	_, err := pool.GetHandle("", nil, func() (interface{}, func()) {
+		return nil, nil
+	})
+	if err != grouped.ErrFetchFailed {
+		t.Fatalf("Expected ErrFetchFailed, got %v", err)
+	}
+}
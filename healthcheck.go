@@ -0,0 +1,158 @@
+package grouped
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthChecker periodically checks the idle entries of a RefCache, which have no references other
+// than the cache's own, removing and closing entries that fail the check so that the next call to
+// Get fetches a fresh value. Entries are held open while being checked, and a call to Get for an
+// entry being checked removes the entry from the cache and fetches a fresh value rather than sharing
+// the value with the check.
+type HealthChecker struct {
+	Cache *RefCache
+	// Returns an error if the value is no longer usable. The context is done when the Timeout
+	// elapses or the checker is closed.
+	Check func(ctx context.Context, value interface{}) error
+	// The time between the start of rounds of checks. Defaults to one minute.
+	Interval time.Duration
+	// If set, the time after which a check's context is done.
+	Timeout time.Duration
+	// The maximum number of checks running at once. Defaults to 1.
+	Concurrency int
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start launches the checker's background routine. It has no effect if the checker is already
+// running.
+func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.run(ctx, h.done)
+}
+
+// Close stops the checker's background routine, canceling the contexts of any running checks and
+// waiting for them to return.
+func (h *HealthChecker) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	<-h.done
+	h.cancel, h.done = nil, nil
+}
+
+func (h *HealthChecker) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	interval := h.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.checkIdle(ctx)
+	}
+}
+
+// checkIdle runs one round of checks on the cache's idle entries.
+func (h *HealthChecker) checkIdle(ctx context.Context) {
+	concurrency := h.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, rec := range h.Cache.idleEntries() {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !h.Cache.beginCheck(rec.key, rec.item) {
+			<-sem
+			continue
+		}
+		wg.Add(1)
+		go func(rec refIdleRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			checkCtx := ctx
+			if h.Timeout > 0 {
+				var cancel context.CancelFunc
+				checkCtx, cancel = context.WithTimeout(ctx, h.Timeout)
+				defer cancel()
+			}
+			healthy := h.Check(checkCtx, rec.item.value) == nil || ctx.Err() != nil
+			h.Cache.returnChecked(rec.key, rec.item, healthy)
+		}(rec)
+	}
+	wg.Wait()
+}
+
+// idleEntries returns the filled entries that have no references other than the cache's own.
+func (p *RefCache) idleEntries() []refIdleRecord {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var idle []refIdleRecord
+	for key, item := range p.items {
+		if item.filled() && atomic.LoadInt32(&item.refs) == 1 {
+			idle = append(idle, refIdleRecord{key: key, item: item})
+		}
+	}
+	return idle
+}
+
+// beginCheck takes a reference to the item for checking it, if it is still in the cache and has no
+// references other than the cache's own. While the item is being checked, Get removes it from the
+// cache rather than returning it. The reference does not affect the item's idle tracking.
+func (p *RefCache) beginCheck(key string, item *refCacheItem) bool {
+	// The write lock excludes calls to Get taking a reference, so that they either see the item as
+	// being checked or are seen as references to the item.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.items[key] != item || atomic.LoadInt32(&item.refs) != 1 {
+		return false
+	}
+	item.ref()
+	atomic.StoreInt32(&item.checking, 1)
+	return true
+}
+
+// returnChecked releases a reference taken by beginCheck, removing the entry from the cache if it
+// is not healthy.
+func (p *RefCache) returnChecked(key string, item *refCacheItem, healthy bool) {
+	atomic.StoreInt32(&item.checking, 0)
+	if !healthy {
+		p.mu.Lock()
+		unlinked := p.unlink(key, item)
+		p.mu.Unlock()
+		if unlinked {
+			item.close()
+		}
+	}
+	if item.unref() == 1 {
+		p.resumeIdle(key, item)
+	}
+}
@@ -0,0 +1,114 @@
+package grouped_test
+
+import (
+	"context"
+	"errors"
+	"github.com/devnev/go-grouped"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker_Start_ClosesUnhealthyIdleEntries(t *testing.T) {
+	var pool grouped.RefCache
+	closed := make(chan struct{})
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { close(closed) }
+	})
+	release()
+
+	checker := grouped.HealthChecker{
+		Cache: &pool,
+		Check: func(context.Context, interface{}) error {
+			return errors.New("unhealthy")
+		},
+		Interval: time.Millisecond,
+	}
+	checker.Start()
+	defer checker.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
+
+func TestHealthChecker_Start_KeepsIdleTimeout(t *testing.T) {
+	pool := grouped.RefCache{IdleTimeout: 20 * time.Millisecond}
+	closed := make(chan struct{})
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { close(closed) }
+	})
+	release()
+
+	checked := make(chan struct{})
+	checker := grouped.HealthChecker{
+		Cache: &pool,
+		Check: func(context.Context, interface{}) error {
+			select {
+			case <-checked:
+			default:
+				// Hold the entry past its IdleTimeout during the first check.
+				time.Sleep(50 * time.Millisecond)
+				close(checked)
+			}
+			return nil
+		},
+		Interval: time.Millisecond,
+	}
+	checker.Start()
+	defer checker.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
+
+func TestHealthChecker_Start_DoesNotShareEntryBeingChecked(t *testing.T) {
+	var pool grouped.RefCache
+	fetches := 0
+	closed := make(chan int, 2)
+	fetch := func() (interface{}, func()) {
+		fetches++
+		n := fetches
+		return n, func() { closed <- n }
+	}
+	_, release := pool.Get("", nil, fetch)
+	release()
+
+	checking, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	checker := grouped.HealthChecker{
+		Cache: &pool,
+		Check: func(ctx context.Context, _ interface{}) error {
+			once.Do(func() {
+				close(checking)
+				select {
+				case <-unblock:
+				case <-ctx.Done():
+				}
+			})
+			return nil
+		},
+		Interval: time.Millisecond,
+	}
+	checker.Start()
+	defer checker.Close()
+	<-checking
+
+	val, release := pool.Get("", nil, fetch)
+	defer release()
+	if val != 2 {
+		t.Fatalf("Expected fresh value while entry is checked, got %v", val)
+	}
+	close(unblock)
+	select {
+	case n := <-closed:
+		if n != 1 {
+			t.Fatalf("Expected checked entry to be closed, got %d", n)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
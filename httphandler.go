@@ -0,0 +1,229 @@
+package grouped
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CollapsingHandler wraps an http.Handler, collapsing concurrent identical requests onto a single
+// execution of the wrapped handler and replaying the recorded response to every waiting client.
+// Requests are identical if they have the same method, host, path, query and values for the
+// configured headers. If the client of the request being handled disconnects, the wrapped handler
+// is executed again for another waiting request, as with CtxCalls. As responses are recorded before
+// being replayed, the wrapped handler should not stream its responses.
+// Requests carrying Authorization or Cookie headers are passed directly to the wrapped handler
+// unless those headers are listed in Headers, so that a response personalized for one client is not
+// replayed to others. Likewise, responses that set cookies, are marked private or no-store, or vary
+// on headers not listed in Headers are neither cached nor replayed, and the other waiting requests
+// are passed to the wrapped handler.
+type CollapsingHandler struct {
+	Handler http.Handler
+	// Request headers that must match for requests to be collapsed, such as ones the response
+	// varies on.
+	Headers []string
+	// Methods of requests that may be collapsed, which must be idempotent. Defaults to GET and HEAD.
+	// Requests with other methods are passed directly to the wrapped handler.
+	Methods []string
+	// If set, responses are also cached for the given duration and replayed to later identical
+	// requests. Responses with server error status codes are not cached.
+	CacheTTL time.Duration
+
+	calls     CtxCalls
+	cache     CtxCache
+	cacheInit sync.Once
+}
+
+func (h *CollapsingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.collapses(r.Method) || hasUnkeyedHeaders(r.Header, credentialHeaders, h.Headers) {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	key := h.key(r)
+	recorded := false
+	record := func(context.Context) (interface{}, error) {
+		recorded = true
+		rec := &recordedResponse{header: make(http.Header)}
+		h.Handler.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if !sharable(rec.header, h.Headers) {
+			return nil, privateResponse{rec}
+		}
+		if rec.status >= 500 {
+			return nil, uncachedResponse{rec}
+		}
+		return rec, nil
+	}
+
+	var res interface{}
+	var status Status
+	var err error
+	if h.CacheTTL > 0 {
+		h.cacheInit.Do(func() {
+			h.cache.TTL = h.CacheTTL
+		})
+		res, status, err = h.cache.Get(r.Context(), key, record)
+	} else {
+		res, status, err = h.calls.Do(r.Context(), key, func() (interface{}, error) {
+			return record(r.Context())
+		})
+	}
+	if status == Canceled {
+		return
+	}
+	if uncached, ok := err.(uncachedResponse); ok {
+		res = uncached.rec
+	} else if private, ok := err.(privateResponse); ok {
+		if !recorded {
+			// The response was for the request that was executed, so this request gets its own.
+			h.Handler.ServeHTTP(w, r)
+			return
+		}
+		res = private.rec
+	}
+	res.(*recordedResponse).replay(w, r)
+}
+
+func (h *CollapsingHandler) collapses(method string) bool {
+	if len(h.Methods) == 0 {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	for _, m := range h.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *CollapsingHandler) key(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Method)
+	key.WriteByte(0)
+	key.WriteString(r.Host)
+	key.WriteByte(0)
+	key.WriteString(r.URL.Path)
+	key.WriteByte('?')
+	key.WriteString(r.URL.RawQuery)
+	for _, name := range h.Headers {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return key.String()
+}
+
+// credentialHeaders are request headers identifying the client, whose responses may be
+// personalized.
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// hasUnkeyedHeaders reports whether the request has any of the named headers that are not among
+// the headers included in its key, in which case it must not share a response with other requests.
+func hasUnkeyedHeaders(header http.Header, names, keyed []string) bool {
+	for _, name := range names {
+		if len(header[name]) == 0 {
+			continue
+		}
+		if !keyedHeader(keyed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharable reports whether a response with the given headers may be replayed to other requests with
+// the same key. Responses setting cookies, marked private or no-store, or varying on headers that
+// are not included in the key are specific to the request they were made for.
+func sharable(header http.Header, keyed []string) bool {
+	if len(header["Set-Cookie"]) > 0 {
+		return false
+	}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				directive = strings.TrimSpace(directive[:i])
+			}
+			if directive == "private" || directive == "no-store" {
+				return false
+			}
+		}
+	}
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || name != "" && !keyedHeader(keyed, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// keyedHeader reports whether the header is among the headers included in the key.
+func keyedHeader(keyed []string, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, k := range keyed {
+		if http.CanonicalHeaderKey(k) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedResponse records the response of a handler so that it can be replayed to other clients.
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recordedResponse) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recordedResponse) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *recordedResponse) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (rec *recordedResponse) replay(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	for name, values := range rec.header {
+		header[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(rec.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(rec.body.Bytes())
+	}
+}
+
+// uncachedResponse is returned as an error to share a response with the group without caching it.
+type uncachedResponse struct {
+	rec *recordedResponse
+}
+
+func (uncachedResponse) Error() string {
+	return "grouped: uncached response"
+}
+
+// privateResponse is returned as an error for a response that must not be cached or replayed to the
+// other members of the group, which execute the handler for their own requests instead.
+type privateResponse struct {
+	rec *recordedResponse
+}
+
+func (privateResponse) Error() string {
+	return "grouped: private response"
+}
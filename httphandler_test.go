@@ -0,0 +1,132 @@
+package grouped_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/devnev/go-grouped"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollapsingHandler_ServeHTTP_ReplaysCachedResponse(t *testing.T) {
+	called := 0
+	handler := &grouped.CollapsingHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			w.Header().Set("X-Test", "value")
+			_, _ = w.Write([]byte("body"))
+		}),
+		CacheTTL: time.Minute,
+	}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/path", nil))
+		if rec.Body.String() != "body" || rec.Header().Get("X-Test") != "value" {
+			t.Fatalf("Expected replayed response, got %q", rec.Body.String())
+		}
+	}
+	if called != 1 {
+		t.Fatalf("Expected 1 call to handler, got %d", called)
+	}
+}
+
+func TestCollapsingHandler_ServeHTTP_DoesNotShareCredentialedResponses(t *testing.T) {
+	called := 0
+	handler := &grouped.CollapsingHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+		}),
+		CacheTTL: time.Minute,
+	}
+	for _, auth := range []string{"first", "second"} {
+		req := httptest.NewRequest(http.MethodGet, "/path", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Body.String() != auth {
+			t.Fatalf("Expected response for %q, got %q", auth, rec.Body.String())
+		}
+	}
+	if called != 2 {
+		t.Fatalf("Expected 2 calls to handler, got %d", called)
+	}
+}
+
+// servesTwice serves two identical GET requests through a caching CollapsingHandler wrapping a
+// handler that sets the given response header, returning the number of calls to the handler.
+func servesTwice(t *testing.T, name, value string, keyed []string) int {
+	called := 0
+	handler := &grouped.CollapsingHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			w.Header().Set(name, value)
+			_, _ = w.Write([]byte("body"))
+		}),
+		Headers:  keyed,
+		CacheTTL: time.Minute,
+	}
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/path", nil))
+		if rec.Body.String() != "body" {
+			t.Fatalf("Expected response body, got %q", rec.Body.String())
+		}
+	}
+	return called
+}
+
+func TestCollapsingHandler_ServeHTTP_DoesNotShareResponsesSettingCookies(t *testing.T) {
+	if called := servesTwice(t, "Set-Cookie", "session=1", nil); called != 2 {
+		t.Fatalf("Expected 2 calls to handler, got %d", called)
+	}
+}
+
+func TestCollapsingHandler_ServeHTTP_DoesNotSharePrivateResponses(t *testing.T) {
+	for _, value := range []string{"private", "max-age=60, no-store"} {
+		if called := servesTwice(t, "Cache-Control", value, nil); called != 2 {
+			t.Fatalf("Expected 2 calls to handler for %q, got %d", value, called)
+		}
+	}
+}
+
+func TestCollapsingHandler_ServeHTTP_SharesResponsesVaryingOnKeyedHeaders(t *testing.T) {
+	if called := servesTwice(t, "Vary", "Accept-Language", nil); called != 2 {
+		t.Fatalf("Expected 2 calls to handler for unkeyed Vary header, got %d", called)
+	}
+	if called := servesTwice(t, "Vary", "Accept-Language", []string{"accept-language"}); called != 1 {
+		t.Fatalf("Expected 1 call to handler for keyed Vary header, got %d", called)
+	}
+}
+
+func TestCollapsingHandler_ServeHTTP_DoesNotReplayPrivateResponsesToWaitingRequests(t *testing.T) {
+	second := newWaitedContext(context.Background())
+	started := make(chan struct{})
+	var calls int32
+	handler := &grouped.CollapsingHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&calls, 1)
+			if n == 1 {
+				// Hold the first request until the second is waiting for its response.
+				close(started)
+				<-second.waited
+			}
+			w.Header().Set("Set-Cookie", fmt.Sprintf("session=%d", n))
+		}),
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/path", nil))
+		first <- rec
+	}()
+	<-started
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/path", nil).WithContext(second))
+	if a, b := (<-first).Header().Get("Set-Cookie"), rec.Header().Get("Set-Cookie"); a == b {
+		t.Fatalf("Expected each request to receive its own cookie, got %q and %q", a, b)
+	}
+}
@@ -0,0 +1,151 @@
+package grouped
+
+import (
+	"sync"
+	"time"
+)
+
+// Janitor periodically removes expired entries from a Cache, and invalid entries from a RefCache,
+// as an alternative to calling Purge. Entries are examined in small chunks, releasing the cache's
+// locks between chunks and while calling the callbacks, so that the sweeps do not hold up calls to
+// Get.
+type Janitor struct {
+	// The caches to maintain. Either may be nil.
+	Cache    *Cache
+	RefCache *RefCache
+	// The time between the start of sweeps. Defaults to one minute.
+	Interval time.Duration
+	// The number of entries examined per chunk. Defaults to 100.
+	ChunkSize int
+	// If set, entries for which the callback returns false are removed, as with Purge.
+	Keep func(interface{}) bool
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start launches the janitor's background routine. It has no effect if the janitor is already
+// running.
+func (j *Janitor) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil {
+		return
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go j.run(j.stop, j.done)
+}
+
+// Close stops the janitor's background routine, waiting for any ongoing sweep to finish its current
+// chunk.
+func (j *Janitor) Close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop == nil {
+		return
+	}
+	close(j.stop)
+	<-j.done
+	j.stop, j.done = nil, nil
+}
+
+func (j *Janitor) run(stop, done chan struct{}) {
+	defer close(done)
+	interval := j.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if j.Cache != nil {
+			j.sweep(stop, j.Cache.keys, j.Cache.sweep)
+		}
+		if j.RefCache != nil {
+			j.sweep(stop, j.RefCache.keys, j.RefCache.sweep)
+		}
+	}
+}
+
+func (j *Janitor) sweep(stop <-chan struct{}, keys func() []string, sweep func([]string, func(interface{}) bool)) {
+	chunk := j.ChunkSize
+	if chunk <= 0 {
+		chunk = 100
+	}
+	all := keys()
+	for len(all) > 0 {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		n := chunk
+		if n > len(all) {
+			n = len(all)
+		}
+		sweep(all[:n], j.Keep)
+		all = all[n:]
+	}
+}
+
+// keys returns the keys of all the entries in the cache, including expired entries.
+func (p *Cache) keys() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	keys := make([]string, 0, len(p.values))
+	for key := range p.values {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// sweep removes the entries for the given keys that have expired, or where the keep callback returns
+// false. The callback is called without holding any lock on the cache.
+func (p *Cache) sweep(keys []string, keep func(interface{}) bool) {
+	type record struct {
+		key   string
+		entry *cacheEntry
+	}
+	records := make([]record, 0, len(keys))
+	p.mu.RLock()
+	for _, key := range keys {
+		if entry, ok := p.values[key]; ok {
+			records = append(records, record{key: key, entry: entry})
+		}
+	}
+	p.mu.RUnlock()
+
+	now := time.Now()
+	stale := records[:0]
+	for _, rec := range records {
+		if rec.entry.expired(now) || keep != nil && !rec.entry.failed && !keep(rec.entry.value) {
+			stale = append(stale, rec)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	var removed, purged []cacheRemoval
+	p.mu.Lock()
+	for _, rec := range stale {
+		if p.values[rec.key] == rec.entry {
+			removed = append(removed, p.remove(rec.key, Purged)...)
+		}
+	}
+	p.mu.Unlock()
+	for _, rem := range removed {
+		if rem.reason == Purged {
+			purged = append(purged, rem)
+		}
+	}
+	p.notify(removed...)
+	p.unsave(purged...)
+}
@@ -0,0 +1,29 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+	"time"
+)
+
+func TestJanitor_Start_RemovesExpiredEntries(t *testing.T) {
+	removed := make(chan grouped.RemoveReason, 1)
+	pool := grouped.Cache{
+		TTL: time.Millisecond,
+		OnRemove: func(key string, value interface{}, reason grouped.RemoveReason) {
+			removed <- reason
+		},
+	}
+	pool.Set("key", "value")
+	janitor := grouped.Janitor{Cache: &pool, Interval: time.Millisecond}
+	janitor.Start()
+	defer janitor.Close()
+	select {
+	case reason := <-removed:
+		if reason != grouped.Expired {
+			t.Fatalf("Expected Expired removal, got %v", reason)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
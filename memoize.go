@@ -0,0 +1,104 @@
+package grouped
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// KeyFunc derives the key for a call to a wrapped function from the call's arguments, not including
+// the context.
+type KeyFunc func(args []interface{}) string
+
+// DefaultKey derives a key by formatting each argument using the %#v verb. Note that pointers are
+// formatted as addresses rather than by the values they point to.
+func DefaultKey(args []interface{}) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = fmt.Sprintf("%#v", arg)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Dedupe wraps a function so that concurrent calls with the same key share the result of a single
+// call to the function, using CtxCalls. The function must have a signature of the form
+// func(context.Context, A...) (R, error), and the returned function has the same signature and
+// must be converted back to it using a type assertion. If key is nil, DefaultKey is used. The keys
+// of each wrapped function are distinct from those of other wrapped functions, so the same calls
+// may be used for several functions.
+func Dedupe(calls *CtxCalls, fn interface{}, key KeyFunc) interface{} {
+	return wrapFunc(fn, key, func(ctx context.Context, key string, do func(context.Context) (interface{}, error)) (interface{}, error) {
+		val, _, err := calls.Do(ctx, key, func() (interface{}, error) {
+			return do(ctx)
+		})
+		return val, err
+	})
+}
+
+// Memoize wraps a function like Dedupe, but also caches the results of successful calls to the
+// function using CtxCache, so that later calls with the same key return the cached result.
+func Memoize(cache *CtxCache, fn interface{}, key KeyFunc) interface{} {
+	return wrapFunc(fn, key, func(ctx context.Context, key string, do func(context.Context) (interface{}, error)) (interface{}, error) {
+		val, _, err := cache.Get(ctx, key, do)
+		return val, err
+	})
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+
+	// Incremented for each wrapped function, to keep the keys of wrapped functions distinct.
+	wrapCount uint64
+)
+
+func wrapFunc(fn interface{}, key KeyFunc, call func(context.Context, string, func(context.Context) (interface{}, error)) (interface{}, error)) interface{} {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() < 1 || ft.In(0) != contextType || ft.NumOut() != 2 || ft.Out(1) != errorType {
+		panic(fmt.Sprintf("grouped: cannot wrap %v, expected func(context.Context, ...) (R, error)", ft))
+	}
+	if key == nil {
+		key = DefaultKey
+	}
+	prefix := fmt.Sprintf("%d\x00", atomic.AddUint64(&wrapCount, 1))
+
+	return reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		ctx, _ := in[0].Interface().(context.Context)
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		args := make([]interface{}, len(in)-1)
+		for i, arg := range in[1:] {
+			args[i] = arg.Interface()
+		}
+
+		val, err := call(ctx, prefix+key(args), func(ctx context.Context) (interface{}, error) {
+			callIn := append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, in[1:]...)
+			var out []reflect.Value
+			if ft.IsVariadic() {
+				out = fv.CallSlice(callIn)
+			} else {
+				out = fv.Call(callIn)
+			}
+			err, _ := out[1].Interface().(error)
+			return out[0].Interface(), err
+		})
+
+		result := reflect.New(ft.Out(0)).Elem()
+		if val != nil {
+			if rv := reflect.ValueOf(val); rv.Type().AssignableTo(result.Type()) {
+				result.Set(rv)
+			} else if err == nil {
+				err = fmt.Errorf("grouped: result of type %T is not assignable to %v", val, result.Type())
+			}
+		}
+		errResult := reflect.New(errorType).Elem()
+		if err != nil {
+			errResult.Set(reflect.ValueOf(err))
+		}
+		return []reflect.Value{result, errResult}
+	}).Interface()
+}
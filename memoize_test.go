@@ -0,0 +1,43 @@
+package grouped_test
+
+import (
+	"context"
+	"github.com/devnev/go-grouped"
+	"strings"
+	"testing"
+)
+
+func TestMemoize_CachesResultsByArguments(t *testing.T) {
+	called := 0
+	upper := func(ctx context.Context, s string) (string, error) {
+		called++
+		return strings.ToUpper(s), nil
+	}
+	var cache grouped.CtxCache
+	memoized := grouped.Memoize(&cache, upper, nil).(func(context.Context, string) (string, error))
+	for _, arg := range []string{"a", "a", "b"} {
+		if res, err := memoized(context.Background(), arg); err != nil || res != strings.ToUpper(arg) {
+			t.Fatalf("Expected %q, got %q (%v)", strings.ToUpper(arg), res, err)
+		}
+	}
+	if called != 2 {
+		t.Fatalf("Expected 2 calls to function, got %d", called)
+	}
+}
+
+func TestMemoize_SeparatesFunctionsSharingCache(t *testing.T) {
+	var cache grouped.CtxCache
+	upper := grouped.Memoize(&cache, func(ctx context.Context, s string) (string, error) {
+		return strings.ToUpper(s), nil
+	}, nil).(func(context.Context, string) (string, error))
+	length := grouped.Memoize(&cache, func(ctx context.Context, s string) (int, error) {
+		return len(s), nil
+	}, nil).(func(context.Context, string) (int, error))
+
+	if res, err := upper(context.Background(), "abc"); err != nil || res != "ABC" {
+		t.Fatalf("Expected %q, got %q (%v)", "ABC", res, err)
+	}
+	if res, err := length(context.Background(), "abc"); err != nil || res != 3 {
+		t.Fatalf("Expected 3, got %d (%v)", res, err)
+	}
+}
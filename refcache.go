@@ -1,8 +1,11 @@
 package grouped
 
 import (
+	"container/list"
+	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // RefCache caches and shares the result of calls with the same key until the result is removed from
@@ -11,9 +14,53 @@ import (
 // combination with SetFinalizer to run a cleanup when items are garbage-collected.
 type RefCache struct {
 	Valid func(interface{}) bool
+	// If set, like Valid but the callback receives the entry's information along with its value.
+	// Entries are only considered valid if both callbacks return true.
+	ValidEntry func(Entry) bool
+	// If set, returns the tags to attach to a value when it is fetched, allowing all entries with a
+	// tag to be removed using InvalidateTag.
+	Tags func(key string, value interface{}) []string
+	// If set, entries that have had no references other than the cache's own for the given duration
+	// are removed from the cache and closed.
+	IdleTimeout time.Duration
+	// If set, at most this many entries with no references other than the cache's own are kept in
+	// the cache. When exceeded, the entries that have been idle longest are removed and closed.
+	MaxIdle int
+	// If set, the cache holds at most this many entries. When a new entry is needed and the cache is
+	// full, the entries that have been idle longest are removed and closed. If every entry has
+	// references other than the cache's own, Get waits for an entry to become idle if
+	// WaitForCapacity is set, and otherwise creates the entry, exceeding the limit temporarily.
+	MaxEntries      int
+	WaitForCapacity bool
+	// If set, the time and stack of each reference acquired from the cache is recorded until the
+	// reference is released, and may be listed using Borrowers. This is intended for debugging, as
+	// recording the stacks is expensive.
+	TrackBorrowers bool
+	// If set along with TrackBorrowers, OnLeak is called for references held for longer than the
+	// given duration.
+	LeakThreshold time.Duration
+	// If set along with TrackBorrowers, the callback is called for references reported as leaked,
+	// either due to LeakThreshold or due to their Handle being garbage-collected without being
+	// released.
+	OnLeak func(Leak)
 
-	mu    sync.RWMutex
-	items map[string]*refCacheItem
+	mu     sync.RWMutex
+	items  map[string]*refCacheItem
+	tagged map[string]map[string]struct{}
+	// The items in the cache that are being fetched, which record the tags invalidated during the
+	// fetch as their tags are not yet known.
+	loading map[*refCacheItem]struct{}
+
+	// The list of idle items is guarded by a separate lock so that items can be removed from it by
+	// Get while holding only the read lock. It must be acquired after mu when both are held.
+	idleMu sync.Mutex
+	idle   list.List
+	// Closed and cleared when an entry is removed or becomes idle, to wake up calls to Get waiting
+	// for capacity.
+	freed chan struct{}
+
+	borrowers refBorrowers
+	closed    bool
 }
 
 // Get retrieves the value for the key, calling the fetch method if necessary to retrieve the value.
@@ -22,11 +69,49 @@ type RefCache struct {
 // beginning a new fetch. However, if the fetch fails or is canceled, one new fetch call is
 // initiated for all Get calls that were waiting for result of that call.
 // The successfully cached items are reference-counted, so if the Get call is successful it returns
-// a callback that must be called to free the returned reference.
+// a callback that must be called to free the returned reference. Calling the callback more than once
+// has no effect. GetHandle may be used instead to receive the reference as a Handle.
 // If an entry is removed from the cache or considered invalid, a new entry for the key is created
 // in the cache. However, the previous entry's value is only cleaned up once all references have
 // been closed.
 func (p *RefCache) Get(key string, cancel <-chan struct{}, fetch func() (interface{}, func())) (interface{}, func()) {
+	value, item, _ := p.get(key, cancel, func() (refFetch, bool) {
+		value, closer := fetch()
+		return refFetch{value: value, closer: closer}, closer != nil
+	})
+	if item == nil {
+		return value, nil
+	}
+	return value, p.releaser(key, item)
+}
+
+// GetCtx retrieves the value for the key like Get, but the fetch method takes a context and may fail
+// with an error. The error is returned to all calls waiting for the result of the failed fetch, and
+// the next call for the key initiates a new fetch. If the fetch's context is done, a different
+// waiting call's fetch method is invoked instead, as with CtxCalls. The closer returned by the
+// fetch method may be nil if the value needs no cleanup.
+func (p *RefCache) GetCtx(ctx context.Context, key string, fetch func(context.Context) (interface{}, func(), error)) (interface{}, func(), error) {
+	value, item, err := p.getCtx(ctx, key, fetch)
+	if item == nil {
+		return value, nil, err
+	}
+	return value, p.releaser(key, item), nil
+}
+
+func (p *RefCache) getCtx(ctx context.Context, key string, fetch func(context.Context) (interface{}, func(), error)) (interface{}, *refCacheItem, error) {
+	value, item, err := p.get(key, ctx.Done(), func() (refFetch, bool) {
+		value, closer, err := fetch(ctx)
+		return refFetch{value: value, closer: closer, err: err}, ctx.Err() == nil
+	})
+	if item == nil && err == nil {
+		return nil, nil, ctx.Err()
+	}
+	return value, item, err
+}
+
+// get retrieves the value for the key, returning the item holding a new reference for the caller
+// if successful.
+func (p *RefCache) get(key string, cancel <-chan struct{}, fetch func() (refFetch, bool)) (interface{}, *refCacheItem, error) {
 	// This defer prevents leaking reference-counts when we panic. A successful return will set
 	// filled=true before returning to disable the cleanup.
 	var item *refCacheItem
@@ -47,187 +132,507 @@ func (p *RefCache) Get(key string, cancel <-chan struct{}, fetch func() (interfa
 			item.ref()
 		}
 		p.mu.RUnlock()
+		if item != nil {
+			p.unidle(item)
+		}
 
 		// Slow path, get the write lock and possibly create the map and/or entry.
 		if item == nil {
+			var evicted []*refCacheItem
 			p.mu.Lock()
+			if p.closed {
+				p.mu.Unlock()
+				return nil, nil, ErrClosed
+			}
 			if p.items == nil {
 				p.items = make(map[string]*refCacheItem)
 			}
 			item = p.items[key]
+			// Make space for the new item if the cache is at capacity, evicting idle items or
+			// waiting for items to become idle.
+			for item == nil && p.MaxEntries > 0 && len(p.items) >= p.MaxEntries {
+				if idle := p.popIdle(); idle != nil {
+					evicted = append(evicted, idle)
+					continue
+				}
+				if !p.WaitForCapacity {
+					break
+				}
+				freed := p.capacityFreed()
+				p.mu.Unlock()
+				closeItems(evicted)
+				evicted = nil
+				select {
+				case <-freed:
+				case <-cancel:
+					return nil, nil, nil
+				}
+				p.mu.Lock()
+				if p.closed {
+					p.mu.Unlock()
+					return nil, nil, ErrClosed
+				}
+				item = p.items[key]
+			}
 			if item == nil {
 				item = newCacheItem()
 				// This reference count tracks the reference in the map
 				item.ref()
 				p.items[key] = item
+				if p.loading == nil {
+					p.loading = make(map[*refCacheItem]struct{})
+				}
+				p.loading[item] = struct{}{}
 			}
 			// The item is in the map and we still have the read lock, so we know the reference
 			// count is at least 1, and can increment it safely.
 			item.ref()
 			p.mu.Unlock()
+			p.unidle(item)
+			closeItems(evicted)
+		}
+
+		if atomic.LoadInt32(&item.checking) == 1 {
+			// The item is being used by a HealthChecker, so replace it with a fresh one.
+			p.discard(key, item)
+			continue
 		}
 
 		{
 			// Make sure the item is filled
-			result, status := item.fill(cancel, fetch)
-			if status == Canceled {
-				return result, nil
+			result, status := item.fill(cancel, func(value interface{}) error {
+				return p.publish(key, item, value)
+			}, fetch)
+			if status == Canceled || result.err != nil {
+				p.dropUnfilled(key, item)
+				return result.value, nil, result.err
 			} else if status == Exclusive {
 				// We (ab)use the status Exclusive to indicate that this this call did the fetch,
 				// and can skip the validation callback as the item should be valid for this call
+				if p.isClosed() {
+					return nil, nil, ErrClosed
+				}
 				filled = true
-				return item.value, item.close
+				return item.value, item, nil
 			}
 		}
 
 		// If we have a valid item, we can return it
-		if p.Valid == nil || p.Valid(item.value) {
+		if p.valid(key, item) {
+			if p.isClosed() {
+				return nil, nil, ErrClosed
+			}
 			filled = true
-			return item.value, item.close
+			item.access()
+			return item.value, item, nil
 		}
 
 		// Clear out the invalid item before we try again
-		p.mu.Lock()
-		if p.items[key] != item {
-			// Another caller has already done the cleanup
-			p.mu.Unlock()
-		} else {
-			delete(p.items, key)
-			p.mu.Unlock()
-			item.close()
-		}
+		p.discard(key, item)
+	}
+}
 
-		// Clean up the reference we held for this attempt
+// discard removes the item from the cache if it is the current entry for the key, and closes the
+// caller's reference to the item.
+func (p *RefCache) discard(key string, item *refCacheItem) {
+	p.mu.Lock()
+	if !p.unlink(key, item) {
+		// Another caller has already done the cleanup
+		p.mu.Unlock()
+	} else {
+		p.mu.Unlock()
 		item.close()
 	}
+
+	// Clean up the reference we held for this attempt
+	item.close()
 }
 
 // Delete removes the given key from the pool's entries if present, forcing the removed entry to be
 // re-built the next time it is retrieved. The item's closer will be called once all references to
 // the item have been closed
 func (p *RefCache) Delete(key string) {
+	if item := p.remove(key); item != nil {
+		item.close()
+	}
+}
+
+// Drain removes the given key from the cache's entries like Delete, and returns a channel that is
+// closed once all references to the removed item have been closed and its closer has returned. If
+// the key is not present, the returned channel is already closed.
+func (p *RefCache) Drain(key string) <-chan struct{} {
+	item := p.remove(key)
+	if item == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	drained := item.drained
+	item.close()
+	return drained
+}
+
+// DeleteAndWait removes the given key from the cache's entries like Delete, and waits until all
+// references to the removed item have been closed and its closer has returned, or until the
+// context is done.
+func (p *RefCache) DeleteAndWait(ctx context.Context, key string) error {
+	select {
+	case <-p.Drain(key):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// remove unlinks the item for the key from the cache, returning the item with the cache's reference
+// still held by the caller.
+func (p *RefCache) remove(key string) *refCacheItem {
 	p.mu.RLock()
 	item := p.items[key]
 	p.mu.RUnlock()
 	if item == nil {
-		return
+		return nil
 	}
 	p.mu.Lock()
+	defer p.mu.Unlock()
 	item = p.items[key]
-	delete(p.items, key)
+	if item != nil {
+		p.unlink(key, item)
+	}
+	return item
+}
+
+// dropUnfilled removes the item from the cache if it has not been filled and no calls other than
+// the caller are waiting for it, so that failed fetches do not take up capacity. The caller's
+// reference is left for the caller to close.
+func (p *RefCache) dropUnfilled(key string, item *refCacheItem) {
+	p.mu.Lock()
+	// New references are only taken while holding a lock on the cache, so the count is stable.
+	unlinked := !item.filled() && atomic.LoadInt32(&item.refs) == 2 && p.unlink(key, item)
 	p.mu.Unlock()
-	if item == nil {
-		return
+	if unlinked {
+		item.close()
+	}
+}
+
+// InvalidateTag removes all entries with the given tag from the cache, forcing the removed entries to
+// be re-built the next time they are retrieved. The closers of the removed items are called once all
+// references to the items have been closed.
+func (p *RefCache) InvalidateTag(tag string) {
+	var removed []*refCacheItem
+	p.mu.Lock()
+	for key := range p.tagged[tag] {
+		item := p.items[key]
+		p.unlink(key, item)
+		removed = append(removed, item)
+	}
+	for item := range p.loading {
+		item.invalidated = append(item.invalidated, tag)
+	}
+	p.mu.Unlock()
+	for _, item := range removed {
+		item.close()
+	}
+}
+
+// publish attaches the tags for a newly fetched value to its item before the item is filled, so
+// that InvalidateTag sees the tags as soon as the value is visible. If one of the tags was
+// invalidated during the fetch, the item is removed from the cache so that the value is only used
+// by the calls waiting for it. Returns ErrClosed if the cache has been closed. Must be called
+// without holding any lock on the cache.
+func (p *RefCache) publish(key string, item *refCacheItem, value interface{}) error {
+	var tags []string
+	if p.Tags != nil {
+		tags = p.Tags(key, value)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	invalidated := item.invalidated
+	item.invalidated = nil
+	delete(p.loading, item)
+	if p.items[key] != item {
+		return nil
+	}
+	for _, tag := range tags {
+		for _, inv := range invalidated {
+			if tag == inv {
+				p.unlink(key, item)
+				// The caller holds a reference to the item, so this is not the last one.
+				item.close()
+				return nil
+			}
+		}
+	}
+	item.tags = tags
+	for _, tag := range tags {
+		if p.tagged == nil {
+			p.tagged = make(map[string]map[string]struct{})
+		}
+		if p.tagged[tag] == nil {
+			p.tagged[tag] = make(map[string]struct{})
+		}
+		p.tagged[tag][key] = struct{}{}
 	}
-	item.closer()
+	return nil
 }
 
+// unlink removes the item from the cache's entries if it is the current entry for the key, without
+// closing the cache's reference to the item. Must be called with the write lock held.
+func (p *RefCache) unlink(key string, item *refCacheItem) bool {
+	if p.items[key] != item {
+		return false
+	}
+	delete(p.items, key)
+	delete(p.loading, item)
+	p.unidle(item)
+	p.signalFreed()
+	for _, tag := range item.tags {
+		delete(p.tagged[tag], key)
+		if len(p.tagged[tag]) == 0 {
+			delete(p.tagged, tag)
+		}
+	}
+	return true
+}
+
+// Purge removes any filled items from the cache where the callback returns false, or all items if
+// the callback is nil, forcing the removed entries to be re-built the next time they are retrieved.
+// The items' closers will be called once all references to the items have been closed.
 func (p *RefCache) Purge(keep func(interface{}) bool) {
 	if keep == nil {
 		p.mu.Lock()
 		defer p.mu.Unlock()
 		for key, item := range p.items {
-			delete(p.items, key)
+			p.unlink(key, item)
 			item.close()
 		}
 		return
 	}
 
+	p.sweep(p.keys(), keep)
+}
+
+// isClosed reports whether Close has been called.
+func (p *RefCache) isClosed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.closed
+}
+
+// valid checks a filled item using the Valid and ValidEntry callbacks.
+func (p *RefCache) valid(key string, item *refCacheItem) bool {
+	if p.Valid != nil && !p.Valid(item.value) {
+		return false
+	}
+	return p.ValidEntry == nil || p.ValidEntry(item.info(key))
+}
+
+// keys returns the keys of all the entries in the cache.
+func (p *RefCache) keys() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	keys := make([]string, 0, len(p.items))
+	for key := range p.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// sweep removes the filled items for the given keys where the Valid or keep callbacks return false.
+// The callbacks are called without holding any lock on the cache.
+func (p *RefCache) sweep(keys []string, keep func(interface{}) bool) {
 	type record struct {
 		key  string
 		item *refCacheItem
 	}
-	var invalid []record
-	{
-		p.mu.RLock()
-		defer p.mu.RUnlock()
-		invalid = make([]record, 0, len(p.items))
-		for key, item := range p.items {
-			if !item.filled() {
-				continue
-			}
-			if p.Valid(item.value) {
-				continue
-			}
-			invalid = append(invalid, record{key: key, item: item})
+	records := make([]record, 0, len(keys))
+	p.mu.RLock()
+	for _, key := range keys {
+		if item := p.items[key]; item != nil && item.filled() {
+			records = append(records, record{key: key, item: item})
 		}
 	}
+	p.mu.RUnlock()
 
+	invalid := records[:0]
+	for _, rec := range records {
+		if !p.valid(rec.key, rec.item) || keep != nil && !keep(rec.item.value) {
+			invalid = append(invalid, rec)
+		}
+	}
 	if len(invalid) == 0 {
 		return
 	}
 
+	var removed []*refCacheItem
 	p.mu.Lock()
-	defer p.mu.Unlock()
 	for _, rec := range invalid {
-		if p.items[rec.key] == rec.item {
-			delete(p.items, rec.key)
-			rec.item.close()
+		if p.unlink(rec.key, rec.item) {
+			removed = append(removed, rec.item)
 		}
 	}
+	p.mu.Unlock()
+	for _, item := range removed {
+		item.close()
+	}
 }
 
 type refCacheItem struct {
-	refs      int32
+	// Accessed atomically, and kept first for alignment.
+	hits       int64
+	lastAccess int64
+
+	refs int32
+	// Set while a HealthChecker is checking the item. Accessed atomically.
+	checking  int32
 	fillCalls atomic.Value
+	// Closed once all references have been closed and the closer has returned.
+	drained   chan struct{}
+	closeOnce sync.Once
 
-	value  interface{}
-	closer func()
+	value   interface{}
+	closer  func()
+	tags    []string
+	created time.Time
+	// The tags invalidated while the item is being fetched, guarded by the cache's mu.
+	invalidated  []string
+	loadDuration time.Duration
+
+	// Guards closer and shut, so that a fetch completing after the item has been shut down calls
+	// its own closer rather than publishing it.
+	mu   sync.Mutex
+	shut bool
+
+	// Guarded by the cache's idleMu.
+	idleElem  *list.Element
+	idleSince time.Time
+	idleTimer *time.Timer
 }
 
 func newCacheItem() *refCacheItem {
 	item := new(refCacheItem)
 	item.fillCalls.Store(new(Calls))
+	item.drained = make(chan struct{})
 	return item
 }
 
-func (i *refCacheItem) fill(cancel <-chan struct{}, get func() (interface{}, func())) (interface{}, Status) {
+// refFetch holds the results of a RefCache fetch method. Results with an error are shared with the
+// group waiting for the item to be filled, without filling the item.
+type refFetch struct {
+	value  interface{}
+	closer func()
+	err    error
+}
+
+// fill fills the item using the fetch method if it has not already been filled. The publish
+// callback is called with the fetched value before the item is filled. If it fails or the item has
+// been shut down by the time the fetch returns, the fetched value is closed instead and the fill
+// fails with the error or ErrClosed.
+func (i *refCacheItem) fill(cancel <-chan struct{}, publish func(interface{}) error, fetch func() (refFetch, bool)) (refFetch, Status) {
 	grp := i.fillCalls.Load().(*Calls)
 	if grp == nil {
 		// The item was already filled by a previous call to the group.
 		// We return status Shared to indicate that this routine didn't do the fetch.
-		return nil, Shared
+		return refFetch{}, Shared
 	}
 	filled := false
 	result, shared := grp.Do("", cancel, func() (interface{}, bool) {
 		if i.filled() {
-			return nil, true
+			return refFetch{}, true
+		}
+		start := time.Now()
+		res, accept := fetch()
+		if !accept || res.err != nil {
+			return res, accept
 		}
-		value, valCloser := get()
-		if valCloser == nil {
-			return value, false
+		err := publish(res.value)
+		i.mu.Lock()
+		if err == nil && i.shut {
+			err = ErrClosed
 		}
-		i.value = value
-		i.closer = valCloser
+		if err != nil {
+			i.mu.Unlock()
+			if res.closer != nil {
+				res.closer()
+			}
+			return refFetch{err: err}, true
+		}
+		i.value = res.value
+		i.closer = res.closer
+		i.mu.Unlock()
+		i.created = time.Now()
+		i.loadDuration = i.created.Sub(start)
 		i.fillCalls.Store((*Calls)(nil))
 		filled = true
-		return nil, true
+		return refFetch{}, true
 	})
+	res, _ := result.(refFetch)
 	if shared == Canceled {
-		return result, Canceled
+		return res, Canceled
 	} else if filled {
 		// We return status Exclusive to indicate that this call did the fetch, and can skip the
 		// validation callback.
-		return nil, Exclusive
+		return refFetch{}, Exclusive
 	}
-	return nil, Shared
+	return res, Shared
 }
 
 func (i *refCacheItem) filled() bool {
 	return i.fillCalls.Load().(*Calls) == nil
 }
 
+func (i *refCacheItem) access() {
+	atomic.AddInt64(&i.hits, 1)
+	atomic.StoreInt64(&i.lastAccess, time.Now().UnixNano())
+}
+
+func (i *refCacheItem) info(key string) Entry {
+	info := Entry{
+		Key:          key,
+		Value:        i.value,
+		Created:      i.created,
+		Hits:         atomic.LoadInt64(&i.hits),
+		LoadDuration: i.loadDuration,
+		Refs:         int(atomic.LoadInt32(&i.refs)) - 1,
+	}
+	if lastAccess := atomic.LoadInt64(&i.lastAccess); lastAccess != 0 {
+		info.LastAccess = time.Unix(0, lastAccess)
+	}
+	return info
+}
+
 func (i *refCacheItem) ref() {
 	atomic.AddInt32(&i.refs, 1)
 }
 
 func (i *refCacheItem) close() {
+	i.unref()
+}
+
+// unref closes a reference to the item, returning the number of remaining references.
+func (i *refCacheItem) unref() int32 {
 	refs := atomic.AddInt32(&i.refs, -1)
 	if refs != 0 {
-		return
-	}
-	// There's a possibility all refs died before the item was filled and the closer was set
-	if i.closer != nil {
-		i.closer()
+		return refs
 	}
+	i.shutdown()
+	return refs
+}
+
+// shutdown calls the item's closer, if it has not already been called.
+func (i *refCacheItem) shutdown() {
+	i.closeOnce.Do(func() {
+		i.mu.Lock()
+		i.shut = true
+		closer := i.closer
+		i.mu.Unlock()
+		// There's a possibility all refs died before the item was filled and the closer was set
+		if closer != nil {
+			closer()
+		}
+		close(i.drained)
+	})
 }
@@ -1,6 +1,8 @@
 package grouped_test
 
 import (
+	"context"
+	"errors"
 	"github.com/devnev/go-grouped"
 	"testing"
 )
@@ -16,3 +18,107 @@ func TestRefCache_Get(t *testing.T) {
 		t.Fatalf("Expected 1 call to callback, got %d", called)
 	}
 }
+
+func TestRefCache_GetCtx_ReturnsFetchError(t *testing.T) {
+	var pool grouped.RefCache
+	fetchErr := errors.New("failed")
+	_, release, err := pool.GetCtx(context.Background(), "", func(context.Context) (interface{}, func(), error) {
+		return nil, nil, fetchErr
+	})
+	if release != nil || err != fetchErr {
+		t.Fatalf("Expected fetch error, got %v", err)
+	}
+}
+
+func TestRefCache_InvalidateTag_ClosesTaggedItems(t *testing.T) {
+	pool := grouped.RefCache{Tags: func(string, interface{}) []string {
+		return []string{"tag"}
+	}}
+	closed := 0
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { closed++ }
+	})
+	release()
+	pool.InvalidateTag("tag")
+	if closed != 1 {
+		t.Fatalf("Expected 1 call to closer, got %d", closed)
+	}
+}
+
+func TestRefCache_InvalidateTag_RemovesItemsBeingFetched(t *testing.T) {
+	pool := grouped.RefCache{Tags: func(string, interface{}) []string {
+		return []string{"tag"}
+	}}
+	fetches, closed := 0, 0
+	fetch := func() (interface{}, func()) {
+		fetches++
+		if fetches == 1 {
+			pool.InvalidateTag("tag")
+		}
+		return fetches, func() { closed++ }
+	}
+	val, release := pool.Get("", nil, fetch)
+	if val != 1 {
+		t.Fatalf("Expected value from first fetch, got %v", val)
+	}
+	release()
+	if closed != 1 {
+		t.Fatalf("Expected invalidated item to be closed once released, got %d closes", closed)
+	}
+	val, release = pool.Get("", nil, fetch)
+	defer release()
+	if val != 2 {
+		t.Fatalf("Expected value from new fetch, got %v", val)
+	}
+}
+
+func TestRefCache_Purge_ClosesRemovedItems(t *testing.T) {
+	var pool grouped.RefCache
+	closed := 0
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { closed++ }
+	})
+	release()
+	pool.Purge(func(interface{}) bool { return false })
+	if closed != 1 {
+		t.Fatalf("Expected 1 call to closer, got %d", closed)
+	}
+}
+
+func TestRefCache_ValidEntry_ReceivesReferenceCount(t *testing.T) {
+	var refs []int
+	pool := grouped.RefCache{ValidEntry: func(entry grouped.Entry) bool {
+		refs = append(refs, entry.Refs)
+		return true
+	}}
+	fetch := func() (interface{}, func()) {
+		return nil, func() {}
+	}
+	_, release := pool.Get("", nil, fetch)
+	defer release()
+	_, release2 := pool.Get("", nil, fetch)
+	defer release2()
+	if len(refs) != 1 || refs[0] != 2 {
+		t.Fatalf("Expected validation with 2 references, got %v", refs)
+	}
+}
+
+func TestRefCache_DeleteAndWait_WaitsForReferences(t *testing.T) {
+	var pool grouped.RefCache
+	closed := 0
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { closed++ }
+	})
+	drained := pool.Drain("")
+	if closed != 0 {
+		t.Fatal("Expected closer not to be called while referenced")
+	}
+	release()
+	<-drained
+	if closed != 1 {
+		t.Fatalf("Expected 1 call to closer, got %d", closed)
+	}
+	if err := pool.DeleteAndWait(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package grouped
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrClosed is returned when retrieving values from a RefCache that has been closed.
+var ErrClosed = errors.New("grouped: cache closed")
+
+// DrainError is returned by RefCache.Close if some entries still had outstanding references when
+// the context was done.
+type DrainError struct {
+	// The keys of the entries that were closed before all their references were released.
+	Keys []string
+	// The error of the context.
+	Err error
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("grouped: %d cache entries not drained: %v", len(e.Keys), e.Err)
+}
+
+func (e *DrainError) Unwrap() error {
+	return e.Err
+}
+
+// Close shuts down the cache. Calls retrieving values from the cache after it is closed fail with
+// ErrClosed, including calls waiting for capacity. All entries are removed from the cache, and
+// Close waits for their outstanding references to be released and their closers to return. If the
+// context is done first, the closers of the remaining entries are called despite their outstanding
+// references, and a DrainError listing their keys is returned.
+func (p *RefCache) Close(ctx context.Context) error {
+	type record struct {
+		key  string
+		item *refCacheItem
+	}
+	var removed []record
+	p.mu.Lock()
+	p.closed = true
+	for key, item := range p.items {
+		p.unlink(key, item)
+		removed = append(removed, record{key: key, item: item})
+	}
+	p.signalFreed()
+	p.mu.Unlock()
+
+	for _, rec := range removed {
+		rec.item.close()
+	}
+
+	var undrained []string
+	for _, rec := range removed {
+		select {
+		case <-rec.item.drained:
+			continue
+		case <-ctx.Done():
+		}
+		// Both channels may be ready, so only report the entry if it has not drained.
+		select {
+		case <-rec.item.drained:
+			continue
+		default:
+		}
+		rec.item.shutdown()
+		undrained = append(undrained, rec.key)
+	}
+	if len(undrained) > 0 {
+		sort.Strings(undrained)
+		return &DrainError{Keys: undrained, Err: ctx.Err()}
+	}
+	return nil
+}
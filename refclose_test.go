@@ -0,0 +1,83 @@
+package grouped_test
+
+import (
+	"context"
+	"errors"
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestRefCache_Close_ReportsUndrainedKeys(t *testing.T) {
+	var pool grouped.RefCache
+	closed := 0
+	fetch := func() (interface{}, func()) {
+		return nil, func() { closed++ }
+	}
+	_, release := pool.Get("held", nil, fetch)
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := pool.Close(ctx)
+	var drainErr *grouped.DrainError
+	if !errors.As(err, &drainErr) || len(drainErr.Keys) != 1 || drainErr.Keys[0] != "held" {
+		t.Fatalf("Expected DrainError for held key, got %v", err)
+	}
+	if closed != 1 {
+		t.Fatalf("Expected 1 call to closer, got %d", closed)
+	}
+	if _, err := pool.GetHandle("other", nil, fetch); err != grouped.ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRefCache_Close_ClosesValuesFetchedAfterClose(t *testing.T) {
+	var pool grouped.RefCache
+	started, unblock := make(chan struct{}), make(chan struct{})
+	closed := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		h, err := pool.GetHandle("", nil, func() (interface{}, func()) {
+			close(started)
+			<-unblock
+			return nil, func() { close(closed) }
+		})
+		if h != nil {
+			h.Release()
+		}
+		result <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.Close(ctx); err == nil {
+		t.Fatalf("Expected DrainError for key being fetched")
+	}
+	close(unblock)
+	if err := <-result; err != grouped.ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+	<-closed
+}
+
+func TestRefCache_Close_ReportsOnlyUndrainedKeys(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		var pool grouped.RefCache
+		fetch := func() (interface{}, func()) {
+			return nil, func() {}
+		}
+		_, release := pool.Get("held", nil, fetch)
+		_, releaseOther := pool.Get("released", nil, fetch)
+		releaseOther()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := pool.Close(ctx)
+		release()
+		var drainErr *grouped.DrainError
+		if !errors.As(err, &drainErr) || len(drainErr.Keys) != 1 || drainErr.Keys[0] != "held" {
+			t.Fatalf("Expected DrainError for only the held key, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package grouped
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type refIdleRecord struct {
+	key  string
+	item *refCacheItem
+}
+
+// markIdle tracks the item as idle if it is in the cache and has no references other than the
+// cache's own, and removes any items that exceed the limits on idle items.
+func (p *RefCache) markIdle(key string, item *refCacheItem) {
+	if p.IdleTimeout <= 0 && p.MaxIdle <= 0 && p.MaxEntries <= 0 {
+		return
+	}
+
+	var removed []*refCacheItem
+	p.mu.Lock()
+	if p.items[key] == item && item.filled() && atomic.LoadInt32(&item.refs) == 1 {
+		p.idleMu.Lock()
+		item.idleSince = time.Now()
+		if item.idleElem == nil {
+			item.idleElem = p.idle.PushBack(refIdleRecord{key: key, item: item})
+		} else {
+			p.idle.MoveToBack(item.idleElem)
+		}
+		if p.IdleTimeout > 0 {
+			if item.idleTimer == nil {
+				item.idleTimer = time.AfterFunc(p.IdleTimeout, func() {
+					p.expireIdle(key, item)
+				})
+			} else {
+				item.idleTimer.Reset(p.IdleTimeout)
+			}
+		}
+		p.idleMu.Unlock()
+	}
+	for p.MaxIdle > 0 {
+		p.idleMu.Lock()
+		full := p.idle.Len() > p.MaxIdle
+		p.idleMu.Unlock()
+		if !full {
+			break
+		}
+		if idle := p.popIdle(); idle != nil {
+			removed = append(removed, idle)
+		}
+	}
+	p.signalFreed()
+	p.mu.Unlock()
+
+	closeItems(removed)
+}
+
+// resumeIdle tracks the item as idle again after a reference that was taken without affecting its
+// idle tracking has been released. If the item is still tracked, the time it became idle is kept
+// and its IdleTimeout is re-armed, as the timer may have fired while the reference was held.
+func (p *RefCache) resumeIdle(key string, item *refCacheItem) {
+	p.idleMu.Lock()
+	tracked := item.idleElem != nil
+	if tracked && item.idleTimer != nil {
+		item.idleTimer.Reset(p.IdleTimeout - time.Since(item.idleSince))
+	}
+	p.idleMu.Unlock()
+	if !tracked {
+		p.markIdle(key, item)
+	}
+}
+
+// popIdle removes the item that has been idle longest from the cache, returning nil if there are no
+// idle items. Must be called with the write lock held.
+func (p *RefCache) popIdle() *refCacheItem {
+	for {
+		p.idleMu.Lock()
+		front := p.idle.Front()
+		p.idleMu.Unlock()
+		if front == nil {
+			return nil
+		}
+		// Items are removed from the idle list by Get after taking a reference, so the front item
+		// may have been borrowed in the meantime.
+		rec := front.Value.(refIdleRecord)
+		if atomic.LoadInt32(&rec.item.refs) == 1 && p.unlink(rec.key, rec.item) {
+			return rec.item
+		}
+		p.unidle(rec.item)
+	}
+}
+
+// capacityFreed returns a channel that is closed when an entry is removed or becomes idle. Must be
+// called with the write lock held.
+func (p *RefCache) capacityFreed() <-chan struct{} {
+	if p.freed == nil {
+		p.freed = make(chan struct{})
+	}
+	return p.freed
+}
+
+// signalFreed wakes up calls waiting for capacity. Must be called with the write lock held.
+func (p *RefCache) signalFreed() {
+	if p.freed != nil {
+		close(p.freed)
+		p.freed = nil
+	}
+}
+
+func closeItems(items []*refCacheItem) {
+	for _, item := range items {
+		item.close()
+	}
+}
+
+// expireIdle removes the item from the cache if it has been idle for the IdleTimeout.
+func (p *RefCache) expireIdle(key string, item *refCacheItem) {
+	p.mu.Lock()
+	p.idleMu.Lock()
+	expired := item.idleElem != nil && time.Since(item.idleSince) >= p.IdleTimeout
+	p.idleMu.Unlock()
+	expired = expired && atomic.LoadInt32(&item.refs) == 1 && p.unlink(key, item)
+	p.mu.Unlock()
+	if expired {
+		item.close()
+	}
+}
+
+// unidle stops tracking the item as idle.
+func (p *RefCache) unidle(item *refCacheItem) {
+	p.idleMu.Lock()
+	defer p.idleMu.Unlock()
+	if item.idleElem != nil {
+		p.idle.Remove(item.idleElem)
+		item.idleElem = nil
+	}
+	if item.idleTimer != nil {
+		item.idleTimer.Stop()
+	}
+}
@@ -0,0 +1,81 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+	"time"
+)
+
+func TestRefCache_MaxIdle_ClosesLongestIdleItem(t *testing.T) {
+	pool := grouped.RefCache{MaxIdle: 1}
+	var closed []string
+	fetch := func(key string) func() (interface{}, func()) {
+		return func() (interface{}, func()) {
+			return key, func() { closed = append(closed, key) }
+		}
+	}
+	_, releaseA := pool.Get("a", nil, fetch("a"))
+	_, releaseB := pool.Get("b", nil, fetch("b"))
+	releaseA()
+	if len(closed) != 0 {
+		t.Fatalf("Expected no items to be closed, got %v", closed)
+	}
+	releaseB()
+	if len(closed) != 1 || closed[0] != "a" {
+		t.Fatalf("Expected longest idle item to be closed, got %v", closed)
+	}
+}
+
+func TestRefCache_IdleTimeout_ClosesIdleItem(t *testing.T) {
+	pool := grouped.RefCache{IdleTimeout: time.Millisecond}
+	closed := make(chan struct{})
+	_, release := pool.Get("", nil, func() (interface{}, func()) {
+		return nil, func() { close(closed) }
+	})
+	release()
+	select {
+	case <-closed:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
+
+func TestRefCache_MaxEntries_EvictsIdleItem(t *testing.T) {
+	pool := grouped.RefCache{MaxEntries: 1, WaitForCapacity: true}
+	closed := 0
+	fetch := func() (interface{}, func()) {
+		return nil, func() { closed++ }
+	}
+	_, releaseA := pool.Get("a", nil, fetch)
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, release := pool.Get("b", cancel, fetch); release != nil {
+		t.Fatal("Expected Get to wait for capacity until canceled")
+	}
+
+	releaseA()
+	_, releaseB := pool.Get("b", nil, fetch)
+	defer releaseB()
+	if closed != 1 {
+		t.Fatalf("Expected idle item to be closed, got %d closes", closed)
+	}
+}
+
+func TestRefCache_MaxEntries_DoesNotCountFailedFetches(t *testing.T) {
+	pool := grouped.RefCache{MaxEntries: 1, WaitForCapacity: true}
+	if _, release := pool.Get("a", nil, func() (interface{}, func()) { return nil, nil }); release != nil {
+		t.Fatal("Expected fetch to fail")
+	}
+
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(time.Minute, func() { close(cancel) })
+	defer timer.Stop()
+	_, release := pool.Get("b", cancel, func() (interface{}, func()) {
+		return nil, func() {}
+	})
+	if release == nil {
+		t.Fatal("Expected Get to succeed after failed fetch")
+	}
+	release()
+}
@@ -0,0 +1,117 @@
+package grouped
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Borrower describes an outstanding reference to a value in a RefCache, as recorded when
+// TrackBorrowers is set.
+type Borrower struct {
+	Key string
+	// The time the reference was acquired.
+	Acquired time.Time
+	// The stack of the goroutine that acquired the reference.
+	Stack []byte
+}
+
+// Leak describes a reference reported as leaked by a RefCache.
+type Leak struct {
+	Borrower
+	// Set if the reference's Handle was garbage-collected without being released, in which case the
+	// reference has been released by the cache. Otherwise the reference has been held for longer
+	// than LeakThreshold, and is still outstanding.
+	Collected bool
+}
+
+type refBorrow struct {
+	Borrower
+	timer *time.Timer
+}
+
+// refBorrowers holds the references tracked by a RefCache.
+type refBorrowers struct {
+	mu      sync.Mutex
+	borrows map[*refBorrow]struct{}
+}
+
+// Borrowers returns the outstanding references to values in the cache. References are only tracked
+// if TrackBorrowers is set.
+func (p *RefCache) Borrowers() []Borrower {
+	p.borrowers.mu.Lock()
+	defer p.borrowers.mu.Unlock()
+	borrowers := make([]Borrower, 0, len(p.borrowers.borrows))
+	for b := range p.borrowers.borrows {
+		borrowers = append(borrowers, b.Borrower)
+	}
+	return borrowers
+}
+
+// releaser returns the callback for closing a reference to the item returned by Get.
+func (p *RefCache) releaser(key string, item *refCacheItem) func() {
+	_, release := p.borrow(key, item)
+	return release
+}
+
+// borrow starts tracking a reference to the item if TrackBorrowers is set, and returns the callback
+// for closing the reference. The callback tracks the item as idle once only the cache's own
+// reference remains, and calls after the first have no effect.
+func (p *RefCache) borrow(key string, item *refCacheItem) (*refBorrow, func()) {
+	var b *refBorrow
+	if p.TrackBorrowers {
+		b = &refBorrow{Borrower: Borrower{Key: key, Acquired: time.Now(), Stack: debug.Stack()}}
+		p.borrowers.mu.Lock()
+		if p.borrowers.borrows == nil {
+			p.borrowers.borrows = make(map[*refBorrow]struct{})
+		}
+		p.borrowers.borrows[b] = struct{}{}
+		if p.LeakThreshold > 0 && p.OnLeak != nil {
+			b.timer = time.AfterFunc(p.LeakThreshold, func() {
+				p.OnLeak(Leak{Borrower: b.Borrower})
+			})
+		}
+		p.borrowers.mu.Unlock()
+	}
+
+	var released int32
+	return b, func() {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			return
+		}
+		if b != nil {
+			p.borrowers.mu.Lock()
+			delete(p.borrowers.borrows, b)
+			if b.timer != nil {
+				b.timer.Stop()
+			}
+			p.borrowers.mu.Unlock()
+		}
+		if item.unref() == 1 {
+			p.markIdle(key, item)
+		}
+	}
+}
+
+// watchHandle reports and releases the handle's reference if the handle is garbage-collected
+// without being released.
+func (p *RefCache) watchHandle(h *Handle, b *refBorrow) {
+	if b == nil {
+		return
+	}
+	runtime.SetFinalizer(h, func(h *Handle) {
+		h.mu.Lock()
+		leaked := !h.released
+		h.released = true
+		h.mu.Unlock()
+		if !leaked {
+			return
+		}
+		h.release()
+		if p.OnLeak != nil {
+			p.OnLeak(Leak{Borrower: b.Borrower, Collected: true})
+		}
+	})
+}
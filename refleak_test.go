@@ -0,0 +1,31 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"testing"
+	"time"
+)
+
+func TestRefCache_TrackBorrowers_ReportsHeldReference(t *testing.T) {
+	leaks := make(chan grouped.Leak, 1)
+	pool := grouped.RefCache{
+		TrackBorrowers: true,
+		LeakThreshold:  time.Millisecond,
+		OnLeak:         func(leak grouped.Leak) { leaks <- leak },
+	}
+	_, release := pool.Get("key", nil, func() (interface{}, func()) {
+		return nil, func() {}
+	})
+	defer release()
+	if borrowers := pool.Borrowers(); len(borrowers) != 1 || borrowers[0].Key != "key" {
+		t.Fatalf("Expected 1 borrower of key, got %v", borrowers)
+	}
+	select {
+	case leak := <-leaks:
+		if leak.Key != "key" || leak.Collected || len(leak.Stack) == 0 {
+			t.Fatalf("Expected held reference to key with stack, got %+v", leak)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("timed out")
+	}
+}
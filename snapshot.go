@@ -0,0 +1,144 @@
+package grouped
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+var snapshotHeader = []byte("grouped.Cache/1\n")
+
+// ErrInvalidSnapshot is returned by Restore if the input is not a snapshot written by Snapshot.
+var ErrInvalidSnapshot = errors.New("grouped: invalid cache snapshot")
+
+// Snapshot writes the values in the cache to the writer, encoded using the cache's Codec, along with
+// their remaining TTL. Cached failures and expired entries are not written. The values are taken
+// from a snapshot of the cache's entries, and are encoded without holding any lock on the cache.
+func (p *Cache) Snapshot(w io.Writer) error {
+	type record struct {
+		key   string
+		entry *cacheEntry
+	}
+	var records []record
+	p.rangeEntries(func(key string, entry *cacheEntry) bool {
+		records = append(records, record{key: key, entry: entry})
+		return true
+	})
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotHeader); err != nil {
+		return err
+	}
+	codec := p.codec()
+	now := time.Now()
+	for _, rec := range records {
+		var ttl time.Duration
+		if !rec.entry.expires.IsZero() {
+			ttl = rec.entry.expires.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		data, err := codec.Marshal(rec.entry.value)
+		if err != nil {
+			return err
+		}
+		writeSnapshotBytes(bw, []byte(rec.key))
+		writeSnapshotUvarint(bw, uint64(ttl))
+		writeSnapshotBytes(bw, data)
+	}
+	return bw.Flush()
+}
+
+// Restore reads values written by Snapshot from the reader, decodes them using the cache's Codec and
+// stores them in the cache with their remaining TTL. Keys that already have a value in the cache
+// keep their existing value. Each value is stored as soon as it is read, so Restore may run while
+// the cache is in use, and values not yet restored are retrieved as usual.
+func (p *Cache) Restore(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != string(snapshotHeader) {
+		return ErrInvalidSnapshot
+	}
+	codec := p.codec()
+	for {
+		key, err := readSnapshotBytes(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ttl, err := binary.ReadUvarint(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		data, err := readSnapshotBytes(br)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		value, err := codec.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+
+		entry := &cacheEntry{value: value}
+		if ttl > 0 {
+			entry.expires = time.Now().Add(time.Duration(ttl))
+		}
+		p.prepare(string(key), entry)
+		p.mu.Lock()
+		var removed []cacheRemoval
+		if existing := p.values[string(key)]; existing == nil || existing.expired(time.Now()) {
+			removed = p.store(string(key), entry)
+		}
+		p.mu.Unlock()
+		p.notify(removed...)
+	}
+}
+
+func (p *Cache) codec() Codec {
+	if p.Codec == nil {
+		return GobCodec{}
+	}
+	return p.Codec
+}
+
+func writeSnapshotUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	_, _ = w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeSnapshotBytes(w *bufio.Writer, b []byte) {
+	writeSnapshotUvarint(w, uint64(len(b)))
+	_, _ = w.Write(b)
+}
+
+func readSnapshotBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// The length is not trusted to allocate the buffer up front, so that a corrupted length fails
+	// once the input runs out rather than exhausting memory.
+	if n > math.MaxInt64 {
+		return nil, ErrInvalidSnapshot
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err == io.EOF {
+		return nil, ErrInvalidSnapshot
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
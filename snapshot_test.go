@@ -0,0 +1,39 @@
+package grouped_test
+
+import (
+	"bytes"
+	"github.com/devnev/go-grouped"
+	"testing"
+)
+
+func TestCache_Restore_LoadsSnapshot(t *testing.T) {
+	var src, dst grouped.Cache
+	src.Set("key", "value")
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if val, ok := dst.Peek("key"); !ok || val != "value" {
+		t.Fatalf("Expected restored value, got %v", val)
+	}
+}
+
+func TestCache_Restore_RejectsCorruptLength(t *testing.T) {
+	var src, dst grouped.Cache
+	src.Set("key", "value")
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	// Replace the key's length with a huge uvarint.
+	data := buf.Bytes()
+	header := len("grouped.Cache/1\n")
+	corrupt := append(append([]byte{}, data[:header]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+	corrupt = append(corrupt, data[header+1:]...)
+	if err := dst.Restore(bytes.NewReader(corrupt)); err != grouped.ErrInvalidSnapshot {
+		t.Fatalf("Expected ErrInvalidSnapshot, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package grouped
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// SocketBus is an InvalidationBus for processes on the same host. Each bus listens on a Unix
+// datagram socket in a shared directory, and events are published by sending them to every other
+// socket in the directory.
+type SocketBus struct {
+	// The directory holding the sockets of all the processes sharing the bus. It is created if it
+	// does not exist.
+	Dir string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+	path string
+	subs LocalBus
+}
+
+// Publish sends the event to every other socket in the directory. Sockets left behind by exited
+// processes are removed.
+func (b *SocketBus) Publish(inv Invalidation) error {
+	conn, err := b.open()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(b.Dir, "*.sock"))
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, path := range paths {
+		if path == b.path {
+			continue
+		}
+		_, err := conn.WriteToUnix(data, &net.UnixAddr{Name: path, Net: "unixgram"})
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			_ = os.Remove(path)
+		} else if err != nil && !errors.Is(err, syscall.ENOENT) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Subscribe registers the callback to be called for events received from other processes.
+func (b *SocketBus) Subscribe(fn func(Invalidation)) (func(), error) {
+	if _, err := b.open(); err != nil {
+		return nil, err
+	}
+	return b.subs.Subscribe(fn)
+}
+
+// Close stops receiving events and removes the bus's socket from the directory.
+func (b *SocketBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	_ = os.Remove(b.path)
+	b.conn = nil
+	return err
+}
+
+func (b *SocketBus) open() (*net.UnixConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(b.Dir, randomID()+".sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	b.conn, b.path = conn, path
+	go b.receive(conn)
+	return conn, nil
+}
+
+func (b *SocketBus) receive(conn *net.UnixConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		var inv Invalidation
+		if json.Unmarshal(buf[:n], &inv) == nil {
+			_ = b.subs.Publish(inv)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package grouped_test
+
+import (
+	"github.com/devnev/go-grouped"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSocketBus_Delete_RemovesFromSubscribedCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	firstBus := &grouped.SocketBus{Dir: dir}
+	defer firstBus.Close()
+	secondBus := &grouped.SocketBus{Dir: dir}
+	defer secondBus.Close()
+	first := grouped.Cache{Bus: firstBus}
+	second := grouped.Cache{Bus: secondBus}
+	if _, err := second.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+	second.Set("key", "value")
+	first.Delete("key")
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		if _, ok := second.Peek("key"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
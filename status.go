@@ -9,4 +9,7 @@ const (
 	Exclusive
 	// Result is from callback and is shared with other routines in the group.
 	Shared
+	// Result is a cached failure, returned by a callback that indicated its result should not be
+	// accepted, and is shared with other routines until the failure expires.
+	Failed
 )
@@ -0,0 +1,70 @@
+package grouped
+
+import "time"
+
+// Store is a slower second-level store for cached values, such as one shared between processes or
+// one that outlives the process. Values are stored as bytes encoded using the cache's Codec.
+type Store interface {
+	// Get retrieves the data stored for the key, returning false if none is stored.
+	Get(key string) ([]byte, bool, error)
+	// Set stores the data for the key, to be removed after the ttl has elapsed if it is non-zero.
+	Set(key string, data []byte, ttl time.Duration) error
+	// Delete removes any data stored for the key.
+	Delete(key string) error
+}
+
+// load retrieves the entry for the key from the cache's Store if it has one.
+func (p *Cache) load(key string) *cacheEntry {
+	if p.Store == nil {
+		return nil
+	}
+	data, ok, err := p.Store.Get(key)
+	if err != nil {
+		p.storeError(key, err)
+		return nil
+	} else if !ok {
+		return nil
+	}
+	value, err := p.codec().Unmarshal(data)
+	if err != nil {
+		p.storeError(key, err)
+		return nil
+	}
+	entry := &cacheEntry{value: value}
+	if p.TTL > 0 {
+		entry.expires = time.Now().Add(p.TTL)
+	}
+	return entry
+}
+
+// save writes the value for the key to the cache's Store if it has one.
+func (p *Cache) save(key string, value interface{}) {
+	if p.Store == nil {
+		return
+	}
+	data, err := p.codec().Marshal(value)
+	if err == nil {
+		err = p.Store.Set(key, data, p.TTL)
+	}
+	if err != nil {
+		p.storeError(key, err)
+	}
+}
+
+// unsave removes the keys from the cache's Store if it has one.
+func (p *Cache) unsave(removed ...cacheRemoval) {
+	if p.Store == nil {
+		return
+	}
+	for _, rem := range removed {
+		if err := p.Store.Delete(rem.key); err != nil {
+			p.storeError(rem.key, err)
+		}
+	}
+}
+
+func (p *Cache) storeError(key string, err error) {
+	if p.OnStoreError != nil {
+		p.OnStoreError(key, err)
+	}
+}
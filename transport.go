@@ -0,0 +1,193 @@
+package grouped
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CoalescingTransport is an http.RoundTripper that deduplicates concurrent identical GET and HEAD
+// requests, sending only one of them upstream and giving each caller its own copy of the response.
+// Requests are identical if they have the same method, URL and values for the configured headers
+// and the Accept, Accept-Encoding and Accept-Language headers.
+// Each caller's request context is honored for that caller, but the upstream request is only
+// aborted once all the callers waiting for it have gone. As the upstream request is shared, it is
+// sent with a context that does not carry the values of the callers' contexts.
+// Requests carrying Authorization or Cookie headers are sent upstream on their own unless those
+// headers are listed in Headers, so that a response personalized for one caller is not given to
+// others. Likewise, requests with Range or conditional headers such as If-None-Match are sent on
+// their own unless those headers are listed in Headers, as their responses may be partial or empty.
+type CoalescingTransport struct {
+	// The transport used to send requests upstream. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+	// Request headers that must match for requests to be coalesced.
+	Headers []string
+
+	calls   CtxCalls
+	mu      sync.Mutex
+	flights map[string]*transportFlight
+}
+
+func (t *CoalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead ||
+		req.Body != nil && req.Body != http.NoBody ||
+		hasUnkeyedHeaders(req.Header, credentialHeaders, t.Headers) ||
+		hasUnkeyedHeaders(req.Header, partialHeaders, t.Headers) {
+		return t.base().RoundTrip(req)
+	}
+
+	key := t.key(req)
+	flight := t.join(key)
+	defer t.leave(key, flight)
+
+	res, status, err := t.calls.Do(req.Context(), key, func() (interface{}, error) {
+		flight.once.Do(func() {
+			go flight.send(t.base(), req)
+		})
+		select {
+		case <-flight.done:
+			return flight.resp, flight.err
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	})
+	if err != nil {
+		return nil, err
+	} else if status == Canceled {
+		return nil, req.Context().Err()
+	}
+	return res.(*recordedUpstream).response(req), nil
+}
+
+func (t *CoalescingTransport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func (t *CoalescingTransport) key(req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.Method)
+	key.WriteByte(0)
+	key.WriteString(req.URL.String())
+	for _, name := range negotiationHeaders {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(req.Header[name], ","))
+	}
+	for _, name := range t.Headers {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(req.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return key.String()
+}
+
+// negotiationHeaders are request headers selecting between representations of a resource, which are
+// always included in the key.
+var negotiationHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// partialHeaders are request headers that may make the response partial or empty, such as a 206 or
+// 304 response.
+var partialHeaders = []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"}
+
+// join registers a caller waiting for the upstream request for the key, starting a new flight if
+// there is none or the previous flight has completed.
+func (t *CoalescingTransport) join(key string) *transportFlight {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flights == nil {
+		t.flights = make(map[string]*transportFlight)
+	}
+	flight := t.flights[key]
+	if flight == nil || flight.completed() {
+		ctx, cancel := context.WithCancel(context.Background())
+		flight = &transportFlight{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+		t.flights[key] = flight
+	}
+	flight.callers++
+	return flight
+}
+
+// leave unregisters a caller, aborting the upstream request if it was the last caller.
+func (t *CoalescingTransport) leave(key string, flight *transportFlight) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flight.callers--
+	if flight.callers > 0 {
+		return
+	}
+	flight.cancel()
+	if t.flights[key] == flight {
+		delete(t.flights, key)
+	}
+}
+
+// transportFlight is an upstream request shared by the callers waiting for it.
+type transportFlight struct {
+	callers int
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+
+	done chan struct{}
+	resp *recordedUpstream
+	err  error
+}
+
+func (f *transportFlight) send(base http.RoundTripper, req *http.Request) {
+	defer close(f.done)
+	resp, err := base.RoundTrip(req.WithContext(f.ctx))
+	if err != nil {
+		f.err = err
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		f.err = err
+		return
+	}
+	f.resp = &recordedUpstream{resp: resp, body: body}
+}
+
+func (f *transportFlight) completed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordedUpstream holds an upstream response with its body read into memory.
+type recordedUpstream struct {
+	resp *http.Response
+	body []byte
+}
+
+// response makes a copy of the upstream response for the caller's request.
+func (r *recordedUpstream) response(req *http.Request) *http.Response {
+	resp := *r.resp
+	resp.Header = cloneHeader(r.resp.Header)
+	resp.Trailer = cloneHeader(r.resp.Trailer)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+	if req.Method != http.MethodHead {
+		resp.ContentLength = int64(len(r.body))
+	}
+	resp.Request = req
+	return &resp
+}
+
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	clone := make(http.Header, len(h))
+	for name, values := range h {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,240 @@
+package grouped_test
+
+import (
+	"context"
+	"github.com/devnev/go-grouped"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitedContext records when a caller starts waiting on it. RoundTrip only waits on the request's
+// context after joining the shared upstream request, so this signals that the caller has joined.
+type waitedContext struct {
+	context.Context
+	once   sync.Once
+	waited chan struct{}
+}
+
+func newWaitedContext(ctx context.Context) *waitedContext {
+	return &waitedContext{Context: ctx, waited: make(chan struct{})}
+}
+
+func (c *waitedContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waited) })
+	return c.Context.Done()
+}
+
+// blockingServer starts a server whose handler signals each request's arrival and blocks until
+// released, or until the request is aborted.
+func blockingServer(arrived chan<- *http.Request, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- r
+		select {
+		case <-release:
+			_, _ = w.Write([]byte("body"))
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+// roundTrip sends a GET request through the transport, returning the response body.
+func roundTrip(ctx context.Context, transport http.RoundTripper, url string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestCoalescingTransport_RoundTrip_SendsConcurrentRequestsOnce(t *testing.T) {
+	arrived, release := make(chan *http.Request, 2), make(chan struct{})
+	server := blockingServer(arrived, release)
+	defer server.Close()
+	transport := &grouped.CoalescingTransport{}
+
+	results := make(chan string, 2)
+	go func() {
+		body, _ := roundTrip(context.Background(), transport, server.URL)
+		results <- body
+	}()
+	<-arrived
+	second := newWaitedContext(context.Background())
+	go func() {
+		body, _ := roundTrip(second, transport, server.URL)
+		results <- body
+	}()
+	<-second.waited
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if body := <-results; body != "body" {
+			t.Fatalf("Expected response body, got %q", body)
+		}
+	}
+	if n := len(arrived); n != 0 {
+		t.Fatalf("Expected 1 upstream request, got %d more", n)
+	}
+}
+
+func TestCoalescingTransport_RoundTrip_ContinuesAfterOneCallerCancels(t *testing.T) {
+	arrived, release := make(chan *http.Request, 2), make(chan struct{})
+	server := blockingServer(arrived, release)
+	defer server.Close()
+	transport := &grouped.CoalescingTransport{}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := roundTrip(firstCtx, transport, server.URL)
+		firstErr <- err
+	}()
+	<-arrived
+	second := newWaitedContext(context.Background())
+	secondBody := make(chan string, 1)
+	go func() {
+		body, _ := roundTrip(second, transport, server.URL)
+		secondBody <- body
+	}()
+	<-second.waited
+
+	cancelFirst()
+	if err := <-firstErr; err != context.Canceled {
+		t.Fatalf("Expected canceled caller to fail with context.Canceled, got %v", err)
+	}
+	close(release)
+	if body := <-secondBody; body != "body" {
+		t.Fatalf("Expected remaining caller to receive response body, got %q", body)
+	}
+	if n := len(arrived); n != 0 {
+		t.Fatalf("Expected 1 upstream request, got %d more", n)
+	}
+}
+
+func TestCoalescingTransport_RoundTrip_AbortsAfterAllCallersCancel(t *testing.T) {
+	arrived, release := make(chan *http.Request, 2), make(chan struct{})
+	server := blockingServer(arrived, release)
+	defer server.Close()
+	transport := &grouped.CoalescingTransport{}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := roundTrip(firstCtx, transport, server.URL)
+		errs <- err
+	}()
+	upstream := <-arrived
+	second := newWaitedContext(secondCtx)
+	go func() {
+		_, err := roundTrip(second, transport, server.URL)
+		errs <- err
+	}()
+	<-second.waited
+
+	cancelFirst()
+	<-errs
+	select {
+	case <-upstream.Context().Done():
+		t.Fatal("Expected upstream request to continue while a caller is waiting")
+	default:
+	}
+	cancelSecond()
+	<-errs
+	select {
+	case <-upstream.Context().Done():
+	case <-time.After(time.Minute):
+		t.Fatal("Expected upstream request to be aborted")
+	}
+}
+
+func TestCoalescingTransport_RoundTrip_DoesNotShareCredentialedResponses(t *testing.T) {
+	var hits int32
+	both := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 2 {
+			close(both)
+		}
+		// Hold each request until both have arrived, so that they would be coalesced if allowed.
+		<-both
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &grouped.CoalescingTransport{}}
+	var wg sync.WaitGroup
+	for _, auth := range []string{"first", "second"} {
+		wg.Add(1)
+		go func(auth string) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Header.Set("Authorization", auth)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if body, _ := ioutil.ReadAll(resp.Body); string(body) != auth {
+				t.Errorf("Expected response for %q, got %q", auth, body)
+			}
+		}(auth)
+	}
+	wg.Wait()
+}
+
+func TestCoalescingTransport_RoundTrip_DoesNotShareResponsesForDifferentHeaders(t *testing.T) {
+	for _, header := range [][2]string{
+		{"Range", "bytes=0-1"},
+		{"If-None-Match", `"etag"`},
+		{"Accept", "text/plain"},
+	} {
+		var hits int32
+		both := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&hits, 1) == 2 {
+				close(both)
+			}
+			// Hold each request until both have arrived, so that they would be coalesced if allowed.
+			select {
+			case <-both:
+			case <-time.After(10 * time.Second):
+			}
+			_, _ = w.Write([]byte(r.Header.Get(header[0])))
+		}))
+
+		transport := &grouped.CoalescingTransport{}
+		var wg sync.WaitGroup
+		for _, value := range []string{"", header[1]} {
+			wg.Add(1)
+			go func(value string) {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+				if value != "" {
+					req.Header.Set(header[0], value)
+				}
+				resp, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				if body, _ := ioutil.ReadAll(resp.Body); string(body) != value {
+					t.Errorf("Expected response for %s %q, got %q", header[0], value, body)
+				}
+			}(value)
+		}
+		wg.Wait()
+		server.Close()
+	}
+}